@@ -0,0 +1,319 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	toxiproxy "github.com/Shopify/toxiproxy/client"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/moby/moby/client"
+
+	"github.com/lego/roachnest/pkg/cluster/tools"
+	"github.com/lego/roachnest/pkg/host"
+)
+
+// clusterState is what Attach needs to know of a cluster besides its
+// Docker resources. It is kept as JSON in the stateLabel of the network.
+type clusterState struct {
+	Settings     Settings
+	DockerConfig DockerConfig
+	Bootstrap    Bootstrap
+	// CACert is the PEM encoded certificate of the authority of a secure
+	// cluster, to create client certificates. Its key is in the state
+	// directory of the cluster, on the host that created it.
+	CACert []byte `json:",omitempty"`
+}
+
+func (d *DockerCluster) Settings() Settings {
+	return d.settings
+}
+
+// Name is the name of the cluster, which Attach finds it by. It is the
+// NamePrefix of the cluster with its run ID.
+func (d *DockerCluster) Name() string {
+	return d.dockerConfig.NamePrefix
+}
+
+// networkLabels returns the labels of the network, with the state of the
+// cluster. The CA key of a secure cluster is saved to a file for it.
+func (d *DockerCluster) networkLabels() (map[string]string, error) {
+	state := clusterState{
+		Settings:     d.settings,
+		DockerConfig: d.dockerConfig,
+		Bootstrap:    d.bootstrap,
+	}
+	if d.certs != nil {
+		if err := d.certs.saveCAKey(d.Name()); err != nil {
+			return nil, err
+		}
+		state.CACert = d.certs.caPEM
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	labels := make(map[string]string, len(d.labels)+1)
+	for k, v := range d.labels {
+		labels[k] = v
+	}
+	labels[stateLabel] = string(data)
+	return labels, nil
+}
+
+// List returns the names of the clusters that exist in Docker.
+func List(ctx context.Context, c *client.Client) ([]string, error) {
+	args := filters.NewArgs()
+	args.Add("label", clusterLabel)
+	networks, err := c.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(networks))
+	for _, n := range networks {
+		names = append(names, n.Labels[clusterLabel])
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Attach returns the cluster with the name, created by NewDockerCluster
+// in this or another process, from the state of the Docker daemon. The
+// cluster can be used as if it were created here, except that Cleanup
+// does not free its slot in the budget of the machine. The resources of
+// the nodes are those of their specs, even after UpdateResources.
+func Attach(ctx context.Context, c *client.Client, name string) (*DockerCluster, error) {
+	args := filters.NewArgs()
+	args.Add("label", fmt.Sprintf("%s=%s", clusterLabel, name))
+	networks, err := c.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	if len(networks) != 1 {
+		return nil, fmt.Errorf("found %d networks of cluster %q, expected 1", len(networks), name)
+	}
+	network := networks[0]
+
+	var state clusterState
+	if err := json.Unmarshal([]byte(network.Labels[stateLabel]), &state); err != nil {
+		return nil, fmt.Errorf("invalid state of cluster %q: %v", name, err)
+	}
+	settings := state.Settings
+	localities, err := placeNodes(&settings)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make(map[string]string, len(network.Labels))
+	for k, v := range network.Labels {
+		if k != stateLabel {
+			labels[k] = v
+		}
+	}
+	d := &DockerCluster{
+		c:            c,
+		settings:     settings,
+		dockerConfig: state.DockerConfig,
+		runID:        labels[runLabel],
+		labels:       labels,
+		networkID:    network.ID,
+		bootstrap:    state.Bootstrap,
+		links:        make(map[Link]*toxiproxy.Proxy, settings.Size*settings.Size),
+		cut:          make(map[Link]bool),
+		toxics:       make(map[string]*Toxic),
+		conns:        make(map[ConnOptions]*gatewayConn),
+		adminClient:  &http.Client{Timeout: adminTimeout},
+	}
+	if state.CACert != nil {
+		keyPEM, err := readCAKey(name)
+		if err != nil {
+			return nil, fmt.Errorf("secure cluster %q must be attached on the host that created it: %v", name, err)
+		}
+		if d.certs, err = loadCerts(state.CACert, keyPEM); err != nil {
+			return nil, err
+		}
+		d.certs.stateDir, _ = clusterStateDir(name)
+		d.adminClient.Transport = &http.Transport{TLSClientConfig: d.certs.tlsConfig()}
+	}
+
+	log.Printf("attaching to cluster %q", name)
+	containers, err := c.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+	nodeContainers := make(map[NodeID]string)
+	toxiContainers := make(map[NodeID]string)
+	for _, container := range containers {
+		if v, ok := container.Labels[nodeLabel]; ok {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label %s=%q of container %q", nodeLabel, v, container.ID)
+			}
+			nodeContainers[NodeID(id)] = container.ID
+		}
+		if v, ok := container.Labels[toxiLabel]; ok {
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid label %s=%q of container %q", toxiLabel, v, container.ID)
+			}
+			toxiContainers[NodeID(id)] = container.ID
+		}
+	}
+
+	for i := 0; i < settings.Size; i++ {
+		id := NodeID(i)
+		containerID, ok := nodeContainers[id]
+		if !ok {
+			return nil, fmt.Errorf("cluster %q has no container for %s", name, id)
+		}
+		node, err := d.attachNode(ctx, id, localities[i], containerID)
+		if err != nil {
+			return nil, err
+		}
+		d.nodes = append(d.nodes, node)
+	}
+
+	if settings.SetupToxiproxy {
+		for _, node := range d.nodes {
+			if node.toxi, err = d.attachSidecar(ctx, node.id, toxiContainers[node.id], nil); err != nil {
+				return nil, err
+			}
+			if node.toxiIP, err = node.toxi.IPAddress(ctx); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if settings.ProxyClients {
+		ports := make([]int, 0, settings.Size)
+		for to := 0; to < settings.Size; to++ {
+			ports = append(ports, linkPort(NodeID(to)))
+		}
+		if d.clientToxi, err = d.attachSidecar(ctx, Client, toxiContainers[Client], ports); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.attachLinks(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// attachNode returns the node of an existing container.
+func (d *DockerCluster) attachNode(ctx context.Context, id NodeID, l locality, containerID string) (*dockerNode, error) {
+	info, err := d.c.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return nil, err
+	}
+	spec := d.nodeSpec(id)
+	// The node may have been upgraded to another image.
+	if i := strings.LastIndex(info.Config.Image, ":"); i >= 0 {
+		spec.Image, spec.Tag = info.Config.Image[:i], info.Config.Image[i+1:]
+	}
+	node := &dockerNode{
+		d:           d,
+		id:          id,
+		name:        d.nodeName(id),
+		containerID: containerID,
+		locality:    l,
+		spec:        spec,
+		resources:   spec.Resources,
+		cmd:         info.Config.Cmd,
+		extraHosts:  info.HostConfig.ExtraHosts,
+	}
+	if _, ok := spec.Volumes[defaultStoreDir]; spec.Store == "" && !ok {
+		node.storeVolume = fmt.Sprintf("%s-data", node.name)
+	}
+
+	switch {
+	case info.State.Paused:
+		node.status = host.Paused
+	case info.State.Running:
+		node.status = host.Running
+	case info.State.Status == "created":
+		node.status = host.Created
+	default:
+		node.status = host.Stopped
+	}
+	if info.State.Running {
+		if err := d.readPorts(ctx, node); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+// attachSidecar returns the toxiproxy of the node, or of Client, from
+// its existing container.
+func (d *DockerCluster) attachSidecar(ctx context.Context, id NodeID, containerID string, ports []int) (*tools.DockerToxiproxy, error) {
+	if containerID == "" {
+		return nil, fmt.Errorf("cluster %q has no toxiproxy container for %s", d.Name(), id)
+	}
+	return tools.AttachDockerToxiproxy(ctx, d.c, tools.DockerToxiproxyConfig{
+		Name:        d.toxiName(id),
+		NetworkName: d.dockerConfig.NetworkName,
+		Ports:       ports,
+		Labels:      d.containerLabels(toxiLabel, id),
+	}, containerID)
+}
+
+// attachLinks reads the proxies of every sidecar, and the partitions and
+// toxics on them.
+func (d *DockerCluster) attachLinks() error {
+	for _, toxi := range d.sidecars() {
+		proxies, err := toxi.GetClient().Proxies()
+		if err != nil {
+			return err
+		}
+		for _, l := range d.allLinks() {
+			proxy, ok := proxies[l.proxyName()]
+			if !ok {
+				continue
+			}
+			d.links[l] = proxy
+			for _, t := range proxy.ActiveToxics {
+				if _, ok := partitionToxics[t.Name]; ok {
+					d.cut[l] = true
+					continue
+				}
+				d.attachToxic(l, t.Name, t.Stream)
+			}
+		}
+	}
+	return nil
+}
+
+// attachToxic records that the toxic named name, which was added by
+// addToxic, is on the stream of the link.
+func (d *DockerCluster) attachToxic(l Link, name, stream string) {
+	name = strings.TrimSuffix(name, "-"+stream)
+	t, ok := d.toxics[name]
+	if !ok {
+		t = &Toxic{d: d, name: name}
+		d.toxics[name] = t
+		// Toxics are named <type>-<seq>, and new ones must not reuse
+		// a seq.
+		if i := strings.LastIndex(name, "-"); i >= 0 {
+			if seq, err := strconv.Atoi(name[i+1:]); err == nil && seq > d.toxicSeq {
+				d.toxicSeq = seq
+			}
+		}
+	}
+	t.parts = append(t.parts, toxicPart{link: l, stream: stream})
+}
+
+// allLinks returns every link the cluster may have.
+func (d *DockerCluster) allLinks() []Link {
+	var links []Link
+	for from := Client; from < NodeID(len(d.nodes)); from++ {
+		for to := 0; to < len(d.nodes); to++ {
+			links = append(links, Link{From: from, To: NodeID(to)})
+		}
+	}
+	return links
+}
@@ -0,0 +1,149 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lego/roachnest/pkg/host"
+)
+
+// Bootstrap is how a new cluster is bootstrapped.
+type Bootstrap int
+
+const (
+	// BootstrapAuto picks the mode from the version of the image, see
+	// bootstrapFor.
+	BootstrapAuto Bootstrap = iota
+	// BootstrapLegacy starts the first node without --join, which
+	// bootstraps a cluster, and the other nodes join it.
+	BootstrapLegacy
+	// BootstrapInit starts every node with the full --join list, and runs
+	// cockroach init once.
+	BootstrapInit
+	// BootstrapSingleNode starts a single node with start-single-node.
+	BootstrapSingleNode
+)
+
+func (b Bootstrap) String() string {
+	switch b {
+	case BootstrapAuto:
+		return "auto"
+	case BootstrapLegacy:
+		return "legacy"
+	case BootstrapInit:
+		return "init"
+	case BootstrapSingleNode:
+		return "single-node"
+	}
+	return fmt.Sprintf("Bootstrap(%d)", int(b))
+}
+
+// version is a CockroachDB release version.
+type version struct {
+	major, minor int
+}
+
+func (v version) less(o version) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	return v.minor < o.minor
+}
+
+var (
+	// cockroach init appeared in v1.1, and start-single-node in v19.2.
+	initVersion       = version{1, 1}
+	singleNodeVersion = version{19, 2}
+
+	buildTagRE = regexp.MustCompile(`Build Tag:\s+v(\d+)\.(\d+)`)
+)
+
+// parseVersion parses the output of cockroach version.
+func parseVersion(output string) (version, error) {
+	m := buildTagRE.FindStringSubmatch(output)
+	if m == nil {
+		return version{}, fmt.Errorf("no build tag in cockroach version output: %q", output)
+	}
+	major, err := strconv.Atoi(m[1])
+	if err != nil {
+		return version{}, err
+	}
+	minor, err := strconv.Atoi(m[2])
+	if err != nil {
+		return version{}, err
+	}
+	return version{major, minor}, nil
+}
+
+// bootstrapFor returns the mode that a cluster of the size and version
+// should be bootstrapped with.
+func bootstrapFor(v version, size int) Bootstrap {
+	switch {
+	case v.less(initVersion):
+		return BootstrapLegacy
+	case size == 1 && !v.less(singleNodeVersion):
+		return BootstrapSingleNode
+	}
+	return BootstrapInit
+}
+
+// resolveBootstrap picks the mode of the cluster, from the image of the
+// first node if the settings leave it to auto.
+func (d *DockerCluster) resolveBootstrap(ctx context.Context) (Bootstrap, error) {
+	if d.settings.Bootstrap != BootstrapAuto {
+		return d.settings.Bootstrap, nil
+	}
+	image := d.nodeSpec(0).imageWithTag()
+	output, err := host.DockerRun(ctx, d.c, image, []string{"version"}, d.labels)
+	if err != nil {
+		return 0, err
+	}
+	v, err := parseVersion(output)
+	if err != nil {
+		return 0, err
+	}
+	b := bootstrapFor(v, d.settings.Size)
+	log.Printf("bootstrapping %s (v%d.%d) with %s", image, v.major, v.minor, b)
+	return b, nil
+}
+
+// startCommand returns the command that starts the node, and the nodes
+// it joins.
+func (d *DockerCluster) startCommand(id NodeID) (string, []NodeID) {
+	switch d.bootstrap {
+	case BootstrapSingleNode:
+		return "start-single-node", nil
+	case BootstrapInit:
+		join := make([]NodeID, 0, d.settings.Size)
+		for i := 0; i < d.settings.Size; i++ {
+			join = append(join, NodeID(i))
+		}
+		return "start", join
+	}
+	if id == 0 {
+		return "start", nil
+	}
+	return "start", []NodeID{0}
+}
+
+// initCluster runs cockroach init on the first node, retrying until the
+// node accepts it.
+func (d *DockerCluster) initCluster(ctx context.Context) error {
+	node := d.nodes[0]
+	log.Printf("initializing cluster through node %q", node.name)
+	return poll(ctx, func(ctx context.Context) error {
+		_, err := host.DockerExec(ctx, d.c, node.container(), []string{
+			"/cockroach/cockroach", "init", d.securityFlag(), "--host=localhost:26257",
+		})
+		// A retry after an init that went through, but whose response was
+		// lost, is refused.
+		if err != nil && strings.Contains(err.Error(), "already been initialized") {
+			return nil
+		}
+		return err
+	})
+}
@@ -0,0 +1,115 @@
+package cluster
+
+import "testing"
+
+func TestBootstrapFor(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		output string
+		// size is the number of nodes of the cluster.
+		size    int
+		version version
+		want    Bootstrap
+		wantErr bool
+	}{
+		{
+			name: "v1.0",
+			output: `Build Tag:    v1.0.7
+Build Time:   2017/10/18 17:04:16
+Distribution: CCL
+Platform:     linux amd64
+Go Version:   go1.8.3
+C Compiler:   gcc 6.3.0
+Build SHA-1:  2a1fd5bbd07f28d0f8f9fa58d7c0bfa4d8b40f54
+Build Type:   release-gnu
+`,
+			size:    3,
+			version: version{1, 0},
+			want:    BootstrapLegacy,
+		},
+		{
+			name: "v1.1",
+			output: `Build Tag:    v1.1.9
+Build Time:   2018/10/01 14:29:41
+Distribution: CCL
+Platform:     linux amd64
+Go Version:   go1.8.3
+C Compiler:   gcc 6.3.0
+Build SHA-1:  1b8d4f0b1ae1a1ba2b4d7ef9daa2cb4a6f7ac9ee
+Build Type:   release-gnu
+`,
+			size:    3,
+			version: version{1, 1},
+			want:    BootstrapInit,
+		},
+		{
+			name: "v2.1 single node",
+			output: `Build Tag:    v2.1.6
+Build Time:   2019/03/05 17:33:04
+Distribution: CCL
+Platform:     linux amd64 (x86_64-unknown-linux-gnu)
+Go Version:   go1.10.7
+C Compiler:   gcc 6.3.0
+Build SHA-1:  5c1b3b7a0d0f3a7e0c5ec17a05d2cd0e4a8aef5e
+Build Type:   release-gnu
+`,
+			size:    1,
+			version: version{2, 1},
+			want:    BootstrapInit,
+		},
+		{
+			name: "v19.2 single node",
+			output: `Build Tag:        v19.2.2
+Build Time:       2019/12/11 01:33:43
+Distribution:     CCL
+Platform:         linux amd64 (x86_64-unknown-linux-gnu)
+Go Version:       go1.12.12
+C Compiler:       gcc 6.3.0
+Build SHA-1:      47e22c3a8f7c0b4fb6a8f0d6b9b4f1c0f28a3e6d
+Build Type:       release
+`,
+			size:    1,
+			version: version{19, 2},
+			want:    BootstrapSingleNode,
+		},
+		{
+			name: "v21.2",
+			output: `Build Tag:        v21.2.4
+Build Time:       2022/01/10 18:50:15
+Distribution:     CCL
+Platform:         linux amd64 (x86_64-unknown-linux-gnu)
+Go Version:       go1.16.6
+C Compiler:       gcc 6.5.0
+Build Commit ID:  f4a3b5d6d8c3e0b2a1e5e8c4b1e6e0b1a2c3d4e5
+Build Type:       release
+`,
+			size:    3,
+			version: version{21, 2},
+			want:    BootstrapInit,
+		},
+		{
+			name:    "malformed",
+			output:  "Error: unknown command \"version\" for \"cockroach\"\n",
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v, err := parseVersion(tc.output)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", v)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tc.version {
+				t.Fatalf("parsed %+v, expected %+v", v, tc.version)
+			}
+			if got := bootstrapFor(v, tc.size); got != tc.want {
+				t.Errorf("bootstrapping %d nodes with %s, expected %s", tc.size, got, tc.want)
+			}
+		})
+	}
+}
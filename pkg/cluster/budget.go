@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// The clusters on a machine share a budget, so that running many tests
+// at once, e.g. with go test ./..., does not overwhelm the Docker
+// daemon. Each cluster holds one of the slots, a file lock in slotDir,
+// from its creation until it is cleaned up. The locks are shared by all
+// processes, and are released by the OS when a process dies.
+const (
+	// maxClustersEnv overrides defaultMaxClusters.
+	maxClustersEnv     = "ROACHNEST_MAX_CLUSTERS"
+	defaultMaxClusters = 4
+	slotPollInterval   = 500 * time.Millisecond
+)
+
+var slotDir = filepath.Join(os.TempDir(), "roachnest-slots")
+
+func maxClusters() (int, error) {
+	v := os.Getenv(maxClustersEnv)
+	if v == "" {
+		return defaultMaxClusters, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%s must be a positive number, got %q", maxClustersEnv, v)
+	}
+	return n, nil
+}
+
+// acquireSlot waits until one of the slots is free, and locks it. The
+// slot is released by closing the file.
+func acquireSlot(ctx context.Context) (*os.File, error) {
+	max, err := maxClusters()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(slotDir, 0777); err != nil {
+		return nil, err
+	}
+
+	logged := false
+	for {
+		for i := 0; i < max; i++ {
+			f, err := os.OpenFile(filepath.Join(slotDir, fmt.Sprintf("slot-%d.lock", i)), os.O_CREATE|os.O_RDWR, 0666)
+			if err != nil {
+				return nil, err
+			}
+			err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+			if err == nil {
+				return f, nil
+			}
+			f.Close()
+			if err != syscall.EWOULDBLOCK {
+				return nil, err
+			}
+		}
+		if !logged {
+			log.Printf("waiting for one of %d clusters on this machine to be cleaned up", max)
+			logged = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(slotPollInterval):
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// In secure mode, the certificates of a node are copied into certsDir
+// of its container.
+const (
+	certsDir     = "/cockroach/certs"
+	caKeyFile    = "ca.key"
+	certKeyBits  = 2048
+	certValidity = 365 * 24 * time.Hour
+)
+
+// certs is the certificate authority of a secure cluster. It signs node
+// and client certificates, and keeps the files clients need in dir.
+type certs struct {
+	dir string
+	// stateDir is the state directory of the cluster, once the CA key is
+	// saved in it.
+	stateDir string
+
+	caCert *x509.Certificate
+	caKey  *rsa.PrivateKey
+	caPEM  []byte
+
+	// mu protects clients, the users that have client certificates in
+	// dir.
+	mu      sync.Mutex
+	clients map[string]bool
+}
+
+func newCerts() (*certs, error) {
+	key, err := rsa.GenerateKey(rand.Reader, certKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certTemplate(pkix.Name{
+		Organization: []string{"Cockroach"},
+		CommonName:   "Cockroach CA",
+	})
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageContentCommitment
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return newCertsFrom(der, key)
+}
+
+// loadCerts returns the certificate authority of the PEM encoded CA
+// certificate and key, e.g. of a cluster created by another process.
+func loadCerts(caPEM, keyPEM []byte) (*certs, error) {
+	certBlock, _ := pem.Decode(caPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return nil, errors.New("invalid CA certificate or key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return newCertsFrom(certBlock.Bytes, key)
+}
+
+func newCertsFrom(der []byte, key *rsa.PrivateKey) (*certs, error) {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := ioutil.TempDir("", "roachnest-certs")
+	if err != nil {
+		return nil, err
+	}
+	c := &certs{
+		dir:     dir,
+		caCert:  cert,
+		caKey:   key,
+		caPEM:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		clients: make(map[string]bool),
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ca.crt"), c.caPEM, 0644); err != nil {
+		c.cleanup()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certs) caKeyPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(c.caKey)})
+}
+
+// stateDir has a directory per secure cluster with the key of its CA,
+// for Attach. The key is kept out of the labels of the network, which
+// anyone who can talk to the Docker daemon reads.
+var stateDir = filepath.Join(os.TempDir(), "roachnest-state")
+
+// clusterStateDir returns the state directory of the cluster. Names come
+// from labels that anyone who can talk to the Docker daemon sets, so only
+// names of a directory of their own in stateDir are accepted.
+func clusterStateDir(name string) (string, error) {
+	if name == "" || name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid cluster name %q", name)
+	}
+	return filepath.Join(stateDir, name), nil
+}
+
+// saveCAKey writes the CA key into the state directory of the cluster,
+// readable by the user only.
+func (c *certs) saveCAKey(name string) error {
+	if c.stateDir != "" {
+		return nil
+	}
+	dir, err := clusterStateDir(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir, 0777); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	c.stateDir = dir
+	return ioutil.WriteFile(filepath.Join(dir, caKeyFile), c.caKeyPEM(), 0600)
+}
+
+// readCAKey reads the CA key that saveCAKey wrote for the cluster.
+func readCAKey(name string) ([]byte, error) {
+	dir, err := clusterStateDir(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filepath.Join(dir, caKeyFile))
+}
+
+func certTemplate(subject pkix.Name) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	// Backdate the certificate a little, in case clocks are skewed.
+	now := time.Now().Add(-time.Hour)
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    now,
+		NotAfter:     now.Add(certValidity),
+	}, nil
+}
+
+// sign creates a certificate and key signed by the CA, and returns them
+// PEM encoded.
+func (c *certs) sign(template *x509.Certificate) (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, certKeyBits)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.caCert, &key.PublicKey, c.caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+// nodeCert creates a node certificate, valid as a server for the hosts
+// and as a client for the node user.
+func (c *certs) nodeCert(hosts []string) (certPEM, keyPEM []byte, err error) {
+	template, err := certTemplate(pkix.Name{
+		Organization: []string{"Cockroach"},
+		CommonName:   "node",
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	return c.sign(template)
+}
+
+func (c *certs) clientCert(user string) (certPEM, keyPEM []byte, err error) {
+	template, err := certTemplate(pkix.Name{
+		Organization: []string{"Cockroach"},
+		CommonName:   user,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return c.sign(template)
+}
+
+// clientFiles returns the paths of the client certificate and key of the
+// user in dir, creating them the first time.
+func (c *certs) clientFiles(user string) (certPath, keyPath string, err error) {
+	certPath = filepath.Join(c.dir, fmt.Sprintf("client.%s.crt", user))
+	keyPath = filepath.Join(c.dir, fmt.Sprintf("client.%s.key", user))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.clients[user] {
+		return certPath, keyPath, nil
+	}
+	certPEM, keyPEM, err := c.clientCert(user)
+	if err != nil {
+		return "", "", err
+	}
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		return "", "", err
+	}
+	// lib/pq refuses keys that others can read.
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return "", "", err
+	}
+	c.clients[user] = true
+	return certPath, keyPath, nil
+}
+
+func (c *certs) caPath() string {
+	return filepath.Join(c.dir, "ca.crt")
+}
+
+// tlsConfig trusts the CA, to talk to the admin HTTP API of the nodes.
+func (c *certs) tlsConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.caCert)
+	return &tls.Config{RootCAs: pool}
+}
+
+// nodeArchive returns a tar archive of the certs directory of a node with
+// the hosts. It holds the root client certificate too, so that cockroach
+// commands can be run inside the container.
+func (c *certs) nodeArchive(hosts []string) (*bytes.Buffer, error) {
+	nodeCert, nodeKey, err := c.nodeCert(hosts)
+	if err != nil {
+		return nil, err
+	}
+	rootCert, rootKey, err := c.clientCert(defaultUser)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{
+		Name:     filepath.Base(certsDir) + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0700,
+		ModTime:  time.Now(),
+	}); err != nil {
+		return nil, err
+	}
+	for _, f := range []struct {
+		name string
+		mode int64
+		data []byte
+	}{
+		{"ca.crt", 0644, c.caPEM},
+		{"node.crt", 0644, nodeCert},
+		{"node.key", 0600, nodeKey},
+		{fmt.Sprintf("client.%s.crt", defaultUser), 0644, rootCert},
+		{fmt.Sprintf("client.%s.key", defaultUser), 0600, rootKey},
+	} {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     filepath.Join(filepath.Base(certsDir), f.name),
+			Typeflag: tar.TypeReg,
+			Mode:     f.mode,
+			Size:     int64(len(f.data)),
+			ModTime:  time.Now(),
+		}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func (c *certs) cleanup() error {
+	if c.stateDir != "" {
+		if err := os.RemoveAll(c.stateDir); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(c.dir)
+}
+
+// securityFlag is the flag for cockroach commands to connect, or start,
+// in the security mode of the cluster.
+func (d *DockerCluster) securityFlag() string {
+	if d.certs != nil {
+		return fmt.Sprintf("--certs-dir=%s", certsDir)
+	}
+	return "--insecure"
+}
+
+// copyNodeCerts copies new certificates for the node into its container.
+func (d *DockerCluster) copyNodeCerts(ctx context.Context, node *dockerNode) error {
+	archive, err := d.certs.nodeArchive([]string{node.name, linkHost, "localhost", "127.0.0.1"})
+	if err != nil {
+		return err
+	}
+	log.Printf("copying certificates into container %q", node.container())
+	return d.c.CopyToContainer(ctx, node.container(), filepath.Dir(certsDir), archive, types.CopyToContainerOptions{})
+}
+
+// RotateNodeCert replaces the certificate of the node with a new one,
+// and sends it SIGHUP so that it reloads its certificates while running.
+func (d *DockerCluster) RotateNodeCert(ctx context.Context, id NodeID) error {
+	if d.certs == nil {
+		return errors.New("cluster was not created with Secure")
+	}
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	if err := d.copyNodeCerts(ctx, node); err != nil {
+		return err
+	}
+	log.Printf("reloading certificates of node %q", node.name)
+	return d.c.ContainerKill(ctx, node.container(), "SIGHUP")
+}
@@ -0,0 +1,23 @@
+package cluster
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestClusterStateDir(t *testing.T) {
+	for _, name := range []string{"roach-4f2a9c01d3be", "roach.prod_1"} {
+		dir, err := clusterStateDir(name)
+		if err != nil {
+			t.Errorf("%q: %v", name, err)
+		} else if filepath.Dir(dir) != stateDir {
+			t.Errorf("%q: expected a directory in %s, got %s", name, stateDir, dir)
+		}
+	}
+	// Names come from labels, and must not reach outside of stateDir.
+	for _, name := range []string{"", ".", "..", "../..", "a/../../etc", "/etc", `..\x`, "roach/1"} {
+		if dir, err := clusterStateDir(name); err == nil {
+			t.Errorf("%q: expected an error, got %s", name, dir)
+		}
+	}
+}
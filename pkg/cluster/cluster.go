@@ -3,19 +3,166 @@ package cluster
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lego/roachnest/pkg/host"
 )
 
 type Settings struct {
+	// Size is the number of nodes. It may be left unset with Regions.
 	Size int
+	// Bootstrap is how the cluster is bootstrapped. By default, it is
+	// picked from the version of the image.
+	Bootstrap Bootstrap
+
+	// Regions places the nodes in regions and zones, with --locality.
+	// Latencies is the round-trip latency between each pair of regions,
+	// added to the links between their nodes. It needs SetupToxiproxy.
+	Regions   []Region
+	Latencies map[RegionPair]time.Duration
 
 	SetupToxiproxy bool
+	// ProxyClients routes the SQL connections of GetConnection through
+	// toxiproxy, so that toxics can be added to Link{From: Client, To: n}.
+	ProxyClients bool
+
+	// Secure starts the nodes with certificates instead of --insecure.
+	// The certificates are generated for the cluster.
+	Secure bool
+
+	// DefaultNode is the spec of every node, and Nodes overrides it for
+	// some nodes.
+	DefaultNode NodeSpec
+	Nodes       map[NodeID]NodeSpec
+
+	// ClusterSettings and DefaultZone are applied once the cluster is
+	// ready, before Start returns, followed by the BootstrapSQL files in
+	// order. Values are SQL expressions, so strings must be quoted, e.g.
+	// "'10s'". DefaultZone holds fields of the default zone config, e.g.
+	// gc.ttlseconds.
+	ClusterSettings map[string]string
+	DefaultZone     map[string]string
+	BootstrapSQL    []string
+}
+
+// NodeID identifies a node by its position in the cluster, starting at
+// 0. It matches the suffix of the node's name, not the CockroachDB node
+// ID.
+type NodeID int
+
+func (id NodeID) String() string {
+	if id == Client {
+		return "client"
+	}
+	return fmt.Sprintf("n%d", int(id))
+}
+
+// NodeInfo describes a node and its current state.
+type NodeInfo struct {
+	ID     NodeID
+	Name   string
+	Status host.Status
+	// Locality is the --locality of the node, if it is in a region.
+	Locality string
+	// OOMKilled is set when the node is stopped because the kernel killed
+	// it for running out of memory.
+	OOMKilled bool
+}
+
+// Node is a handle on one node of a cluster. The addresses of a node can
+// change when it restarts, so they should not be kept around.
+type Node interface {
+	ID() NodeID
+	Name() string
+	// SQLAddr is the host:port for SQL clients to connect to.
+	SQLAddr() string
+	// AdminURL is the base URL of the admin UI and HTTP API.
+	AdminURL() string
 }
 
 type Cluster interface {
+	// Start starts every node and blocks until the cluster is ready.
 	Start(context.Context) error
 	Cleanup(context.Context) error
 
+	// WaitUntil blocks until every node in the cluster has reached the
+	// status, or the context is done.
+	WaitUntil(context.Context, host.Status) error
+
+	// GetConnection returns a connection through the first node.
 	GetConnection(ctx context.Context, database string) (*sql.DB, error)
+	// GetConnectionTo returns a connection through a given gateway node.
+	GetConnectionTo(ctx context.Context, id NodeID, database string) (*sql.DB, error)
+	// Connect returns a connection with the options, shared with other
+	// callers that ask for the same options.
+	Connect(context.Context, ConnOptions) (*sql.DB, error)
+	// DSN returns the URL of a connection with the options, for other
+	// drivers.
+	DSN(ConnOptions) (string, error)
+
+	// Settings returns the settings the cluster was created with.
+	Settings() Settings
+
+	// Node returns a handle on a node. It panics if there is no such node.
+	Node(NodeID) Node
+
+	// Nodes reports every node and its current status.
+	Nodes(context.Context) ([]NodeInfo, error)
+
+	// DrainNode gracefully drains a node without stopping it.
+	DrainNode(context.Context, NodeID) error
+	// StopNode drains a node and then stops it.
+	StopNode(context.Context, NodeID) error
+	// KillNode stops a node with SIGKILL.
+	KillNode(context.Context, NodeID) error
+	// PauseNode freezes every process of a node.
+	PauseNode(context.Context, NodeID) error
+	UnpauseNode(context.Context, NodeID) error
+	// RestartNode restarts a node, keeping its store, and waits for it
+	// to rejoin the cluster.
+	RestartNode(context.Context, NodeID) error
+
+	// Partition cuts the network between nodes in different groups.
+	Partition(ctx context.Context, groups ...[]NodeID) error
+	// PartitionOneWay stops one node from reaching another, while the
+	// other can still reach the first.
+	PartitionOneWay(ctx context.Context, from, to NodeID) error
+	// Heal restores every partitioned link.
+	Heal(context.Context) error
+
+	// AddLatency, LimitBandwidth, Timeout, SlowClose, Slicer and
+	// ResetPeer add a toxic to the links of a target. The returned toxic
+	// is removed with Remove.
+	AddLatency(ctx context.Context, target Target, latency, jitter time.Duration) (*Toxic, error)
+	LimitBandwidth(ctx context.Context, target Target, kbps int) (*Toxic, error)
+	Timeout(ctx context.Context, target Target, timeout time.Duration) (*Toxic, error)
+	SlowClose(ctx context.Context, target Target, delay time.Duration) (*Toxic, error)
+	Slicer(ctx context.Context, target Target, averageSize, sizeVariation int, delay time.Duration) (*Toxic, error)
+	ResetPeer(ctx context.Context, target Target, timeout time.Duration) (*Toxic, error)
+	// ResetAllToxics removes every toxic and partition from the network.
+	ResetAllToxics(context.Context) error
+
+	// UpdateResources changes the resource limits of a running node, and
+	// RestoreResources puts back the limits it was created with.
+	UpdateResources(context.Context, NodeID, Resources) error
+	RestoreResources(context.Context, NodeID) error
+
+	// UpgradeNode replaces a node with one running another image or tag,
+	// keeping its store.
+	UpgradeNode(ctx context.Context, id NodeID, image, tag string) error
+	// PreserveDowngrade and FinalizeUpgrade set and reset
+	// cluster.preserve_downgrade_option.
+	PreserveDowngrade(ctx context.Context, version string) error
+	FinalizeUpgrade(context.Context) error
+	// ClusterVersion returns the active version of the cluster.
+	ClusterVersion(context.Context) (string, error)
+	// BuildInfo returns crdb_internal.node_build_info of a node.
+	BuildInfo(context.Context, NodeID) (map[string]string, error)
+
+	// RotateNodeCert gives a node a new certificate and has it reload its
+	// certificates, without restarting it. The cluster must be secure.
+	RotateNodeCert(context.Context, NodeID) error
 }
 
 type Type string
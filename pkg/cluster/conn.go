@@ -0,0 +1,202 @@
+package cluster
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+const (
+	applicationName = "cockroach_testing_client"
+	defaultUser     = "root"
+)
+
+// ConnOptions describes a connection to the cluster. Connections with the
+// same options are shared.
+type ConnOptions struct {
+	// Node is the gateway node of the connection.
+	Node     NodeID
+	Database string
+	// User defaults to root. In secure mode, the user authenticates with
+	// Password if it is set, and with a client certificate otherwise.
+	User     string
+	Password string
+
+	// ApplicationName defaults to cockroach_testing_client.
+	ApplicationName string
+	// StatementTimeout cancels statements that run longer than it. Zero
+	// means no timeout.
+	StatementTimeout time.Duration
+
+	// MaxOpenConns, MaxIdleConns and ConnMaxLifetime configure the pool
+	// of the connection, see sql.DB. Zero values keep the defaults of
+	// database/sql.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// GetConnection returns a connection through the first node.
+func (d *DockerCluster) GetConnection(ctx context.Context, database string) (*sql.DB, error) {
+	return d.Connect(ctx, ConnOptions{Database: database})
+}
+
+// GetConnectionTo returns a connection that uses the node as its gateway.
+func (d *DockerCluster) GetConnectionTo(ctx context.Context, id NodeID, database string) (*sql.DB, error) {
+	return d.Connect(ctx, ConnOptions{Node: id, Database: database})
+}
+
+// Connect returns a connection with the options. The connection is
+// shared by every caller with the same options, and closed by Cleanup.
+func (d *DockerCluster) Connect(ctx context.Context, opts ConnOptions) (*sql.DB, error) {
+	node, err := d.node(opts.Node)
+	if err != nil {
+		return nil, err
+	}
+	port, err := node.clientPort()
+	if err != nil {
+		return nil, err
+	}
+
+	d.connMu.Lock()
+	conn, ok := d.conns[opts]
+	d.connMu.Unlock()
+	if ok && conn.port == port {
+		return conn.db, nil
+	}
+
+	// Dial without holding connMu, so that a gateway that is slow to
+	// answer does not hold up connections to the others.
+	connStr, err := d.dsn(port, opts)
+	if err != nil {
+		return nil, err
+	}
+	// Attempt to connect to the container, with an exponential backoff.
+	var db *sql.DB
+	err = backoff.Retry(func() error {
+		var err error
+		db, err = sql.Open("postgres", connStr)
+		if err != nil {
+			return err
+		}
+		if err := db.PingContext(ctx); err != nil {
+			db.Close()
+			return err
+		}
+		return nil
+	}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+
+	if err != nil {
+		return nil, err
+	}
+	if opts.MaxOpenConns != 0 {
+		db.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	if opts.MaxIdleConns != 0 {
+		db.SetMaxIdleConns(opts.MaxIdleConns)
+	}
+	if opts.ConnMaxLifetime != 0 {
+		db.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	}
+
+	d.connMu.Lock()
+	defer d.connMu.Unlock()
+	if conn, ok := d.conns[opts]; ok {
+		if conn.port == port {
+			// Another caller connected first.
+			db.Close()
+			return conn.db, nil
+		}
+		// The node restarted on another port. Callers may still hold the
+		// old connection, which fails on its own, so it is only closed
+		// by Cleanup.
+		d.stale = append(d.stale, conn.db)
+	}
+	d.conns[opts] = &gatewayConn{db: db, port: port}
+	return db, nil
+}
+
+// DSN returns a postgres:// URL with the options, for drivers other than
+// lib/pq such as pgx. The pool options do not apply to it.
+func (d *DockerCluster) DSN(opts ConnOptions) (string, error) {
+	node, err := d.node(opts.Node)
+	if err != nil {
+		return "", err
+	}
+	port, err := node.clientPort()
+	if err != nil {
+		return "", err
+	}
+	return d.dsn(port, opts)
+}
+
+func (d *DockerCluster) closeConns() {
+	d.connMu.Lock()
+	defer d.connMu.Unlock()
+	for opts, conn := range d.conns {
+		if err := conn.db.Close(); err != nil {
+			log.Printf("closing connection to %s: %v", opts.Node, err)
+		}
+	}
+	d.conns = make(map[ConnOptions]*gatewayConn)
+	for _, db := range d.stale {
+		db.Close()
+	}
+	d.stale = nil
+}
+
+// connString is the URL of a plain connection to the host port.
+func (d *DockerCluster) connString(port int, database string) (string, error) {
+	return d.dsn(port, ConnOptions{Database: database})
+}
+
+func (d *DockerCluster) dsn(port int, opts ConnOptions) (string, error) {
+	user := opts.User
+	if user == "" {
+		user = defaultUser
+	}
+	appName := opts.ApplicationName
+	if appName == "" {
+		appName = applicationName
+	}
+
+	query := url.Values{}
+	query.Set("application_name", appName)
+	userInfo := url.User(user)
+	if d.certs == nil {
+		query.Set("sslmode", "disable")
+	} else {
+		query.Set("sslmode", "verify-full")
+		query.Set("sslrootcert", d.certs.caPath())
+		if opts.Password != "" {
+			userInfo = url.UserPassword(user, opts.Password)
+		} else {
+			certPath, keyPath, err := d.certs.clientFiles(user)
+			if err != nil {
+				return "", err
+			}
+			query.Set("sslcert", certPath)
+			query.Set("sslkey", keyPath)
+		}
+	}
+	if opts.StatementTimeout != 0 {
+		// Unknown parameters set session variables in CockroachDB.
+		query.Set("statement_timeout", strconv.FormatInt(millis(opts.StatementTimeout), 10))
+	}
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     userInfo,
+		Host:     fmt.Sprintf("localhost:%d", port),
+		RawQuery: query.Encode(),
+	}
+	if opts.Database != "" {
+		u.Path = "/" + opts.Database
+	}
+	return u.String(), nil
+}
@@ -5,25 +5,34 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
-	"net"
-	"strconv"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
 
 	toxiproxy "github.com/Shopify/toxiproxy/client"
 
-	"github.com/cenkalti/backoff"
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/network"
+	volumetypes "github.com/docker/docker/api/types/volume"
 	"github.com/docker/go-connections/nat"
 	_ "github.com/lib/pq"
 	"github.com/moby/moby/client"
-	"github.com/phayes/freeport"
 
 	"github.com/lego/roachnest/pkg/cluster/tools"
 	"github.com/lego/roachnest/pkg/host"
 )
 
-const applicationName = "cockroach_testing_client"
+// defaultStoreDir is where a node keeps its store, unless its spec has a
+// Store.
+const defaultStoreDir = "/cockroach/cockroach-data"
+
+// The container ports of a node.
+const (
+	sqlPort   nat.Port = "26257/tcp"
+	adminPort nat.Port = "8080/tcp"
+)
 
 var _ Cluster = &DockerCluster{}
 var _ Config = &DockerConfig{}
@@ -34,23 +43,105 @@ type DockerCluster struct {
 
 	c *client.Client
 
-	networkID    string
-	containerIDs []string
+	// mu protects the status of the nodes.
+	mu sync.Mutex
+
+	// runID identifies the cluster, and labels are set on all of its
+	// resources, see Reap.
+	runID  string
+	labels map[string]string
+	// slot is the lock on the slot of the cluster in the budget of the
+	// machine, held until Cleanup.
+	slot *os.File
+
+	networkID string
+	nodes     []*dockerNode
+	bootstrap Bootstrap
+
+	// conns holds the connections returned by Connect, by their options.
+	// stale holds the connections to ports that nodes no longer listen
+	// on, which callers may still hold, until Cleanup closes them.
+	connMu sync.Mutex
+	conns  map[ConnOptions]*gatewayConn
+	stale  []*sql.DB
+
+	// links holds the proxy of every link between two nodes, when
+	// toxiproxy is set up. cut is the set of partitioned links, and is
+	// protected by mu.
+	links map[Link]*toxiproxy.Proxy
+	cut   map[Link]bool
+
+	// toxics holds the toxics added through the cluster by name, and
+	// toxicSeq numbers them. Both are protected by mu.
+	toxics   map[string]*Toxic
+	toxicSeq int
+
+	// clientToxi carries client connections, with ProxyClients.
+	clientToxi *tools.DockerToxiproxy
+
+	// certs signs the certificates of a secure cluster.
+	certs *certs
+	// adminClient talks to the admin HTTP API of the nodes.
+	adminClient *http.Client
+}
+
+// gatewayConn is a connection, and the host port it goes to. The ports
+// of a node change when it restarts.
+type gatewayConn struct {
+	db   *sql.DB
+	port int
+}
+
+type dockerNode struct {
+	d *DockerCluster
+
+	id   NodeID
+	name string
+	// containerID is the current container of the node, which
+	// UpgradeNode replaces. It is protected by mu.
+	containerID string
 
-	dbPort    int
+	// sqlPort and adminPort are the host ports the node is published on.
+	// They change every time the node starts, and are protected by mu.
+	sqlPort   int
 	adminPort int
-	conn      *sql.DB
-	toxi      *tools.DockerToxiproxy
 
-	proxies map[string]*toxiproxy.Proxy
+	locality locality
+	// spec is the spec of the current container, protected by mu.
+	spec NodeSpec
+	// resources are the current limits of the node, which differ from
+	// the spec after UpdateResources. They are protected by mu.
+	resources Resources
+
+	// toxi is the sidecar carrying outbound traffic of the node, and
+	// toxiIP its address, when toxiproxy is set up.
+	toxi   *tools.DockerToxiproxy
+	toxiIP string
+
+	// cmd and extraHosts are kept to create the container again with
+	// another image.
+	cmd        []string
+	extraHosts []string
+	// storeVolume is the named volume holding the default store of the
+	// node, so that the store outlives the container.
+	storeVolume string
+
+	status host.Status
 }
 
 type DockerConfig struct {
+	// NetworkName and NamePrefix are suffixed with the run ID of each
+	// cluster, so that they can be shared by clusters running at once.
 	NetworkName string
 	NamePrefix  string
 
 	Image string
 	Tag   string
+
+	// Detached clusters outlive the process that creates them, e.g. the
+	// clusters of the CLI. Reap leaves them alone, and they are removed
+	// by attaching to them and calling Cleanup.
+	Detached bool
 }
 
 func (*DockerConfig) Type() Type { return Docker }
@@ -59,173 +150,209 @@ func (d DockerConfig) ImageWithTag() string {
 	return fmt.Sprintf("%s:%s", d.Image, d.Tag)
 }
 
+// NewDockerCluster creates the network, containers and volumes of a
+// cluster. If it fails, it removes whatever it created.
 func NewDockerCluster(ctx context.Context, c *client.Client, settings Settings, dockerConfig DockerConfig) (*DockerCluster, error) {
+	localities, err := placeNodes(&settings)
+	if err != nil {
+		return nil, err
+	}
+	runID, err := newRunID()
+	if err != nil {
+		return nil, err
+	}
+	dockerConfig = namespace(dockerConfig, runID)
 	d := &DockerCluster{
 		c:            c,
 		settings:     settings,
 		dockerConfig: dockerConfig,
-		proxies:      make(map[string]*toxiproxy.Proxy, settings.Size),
+		runID:        runID,
+		labels:       ownerLabels(runID, dockerConfig),
+		links:        make(map[Link]*toxiproxy.Proxy, settings.Size*settings.Size),
+		cut:          make(map[Link]bool),
+		toxics:       make(map[string]*Toxic),
+		conns:        make(map[ConnOptions]*gatewayConn),
+		adminClient:  &http.Client{Timeout: adminTimeout},
 	}
 
-	// Pull the image.
-	if err := host.DockerPreloadImage(d.c, host.DockerConfig{
-		Image: dockerConfig.Image,
-		Tag:   dockerConfig.Tag,
-	}); err != nil {
-		return d, err
-	}
-
-	if d.settings.SetupToxiproxy {
-		if err := tools.PreloadToxiproxyImage(ctx, d.c); err != nil {
-			return d, err
+	if err := d.create(ctx, localities); err != nil {
+		log.Printf("creating cluster failed, rolling back: %v", err)
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cancel()
+		if cleanupErr := d.Cleanup(cleanupCtx); cleanupErr != nil {
+			return nil, fmt.Errorf("%v (and rolling back: %v)", err, cleanupErr)
 		}
+		return nil, err
 	}
+	return d, nil
+}
 
-	// Initialize internal network.
-	log.Printf("creating network %q", dockerConfig.NetworkName)
-	resp, err := d.c.NetworkCreate(ctx,
-		dockerConfig.NetworkName,
-		types.NetworkCreate{
-			Driver: "bridge",
-		},
-	)
-	if err != nil {
-		return d, err
+// create creates the resources of the cluster. Each one is recorded in
+// d as soon as it exists, so that Cleanup can remove it.
+func (d *DockerCluster) create(ctx context.Context, localities []locality) error {
+	settings := d.settings
+
+	var err error
+	if d.slot, err = acquireSlot(ctx); err != nil {
+		return err
 	}
-	d.networkID = resp.ID
 
-	if d.settings.SetupToxiproxy {
-		d.toxi, err = tools.NewDockerToxiproxy(ctx, d.c, tools.DockerToxiproxyConfig{
-			Name:        "toxi",
-			NetworkName: dockerConfig.NetworkName,
-		})
+	if settings.Secure {
+		certs, err := newCerts()
 		if err != nil {
-			return d, err
+			return err
 		}
-		if err := d.toxi.Start(ctx); err != nil {
-			return d, err
+		d.certs = certs
+		d.adminClient.Transport = &http.Transport{TLSClientConfig: certs.tlsConfig()}
+	}
+
+	// Pull the images of every node.
+	pulled := make(map[string]bool)
+	for i := 0; i < settings.Size; i++ {
+		spec := d.nodeSpec(NodeID(i))
+		if pulled[spec.imageWithTag()] {
+			continue
 		}
+		if err := host.DockerPreloadImage(d.c, host.DockerConfig{
+			Image: spec.Image,
+			Tag:   spec.Tag,
+		}); err != nil {
+			return err
+		}
+		pulled[spec.imageWithTag()] = true
 	}
 
-	// Initlaize the first cluster node.
-	firstNodeName := fmt.Sprintf("%s-%d", dockerConfig.NamePrefix, 0)
-	containerID, err := d.addNode(ctx, firstNodeName, "")
-	if err != nil {
-		return d, err
+	if settings.SetupToxiproxy || settings.ProxyClients {
+		if err := tools.PreloadToxiproxyImage(ctx, d.c); err != nil {
+			return err
+		}
 	}
-	d.containerIDs = append(d.containerIDs, containerID)
 
-	// FIXME(joey): Wait for first node to finish starting.
+	if d.bootstrap, err = d.resolveBootstrap(ctx); err != nil {
+		return err
+	}
+	if d.bootstrap == BootstrapSingleNode && settings.Size != 1 {
+		return fmt.Errorf("cannot bootstrap %d nodes with %s", settings.Size, d.bootstrap)
+	}
 
-	for i := 1; i < settings.Size; i++ {
-		nodeName := fmt.Sprintf("%s-%d", dockerConfig.NamePrefix, i)
-		containerID, err := d.addNode(ctx, nodeName, firstNodeName)
-		if err != nil {
-			return d, err
+	// Initialize internal network.
+	if err := d.createNetwork(ctx); err != nil {
+		return err
+	}
+
+	for i := 0; i < settings.Size; i++ {
+		if err := d.addNode(ctx, NodeID(i), localities[i]); err != nil {
+			return err
 		}
-		d.containerIDs = append(d.containerIDs, containerID)
 	}
 
-	return d, nil
+	if err := d.addRegionLatencies(ctx); err != nil {
+		return err
+	}
+
+	if settings.ProxyClients {
+		if err := d.addClientSidecar(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Cleanup removes every resource of the cluster. It keeps going after an
+// error, and returns a CleanupError with all of them.
 func (d *DockerCluster) Cleanup(ctx context.Context) error {
-	if len(d.containerIDs) > 0 {
-		for _, containerID := range d.containerIDs {
-			log.Printf("removing container %q", containerID)
-			if err := d.c.ContainerRemove(
-				ctx,
-				containerID,
-				types.ContainerRemoveOptions{
-					RemoveVolumes: true,
-					Force:         true,
-				}); err != nil {
-				log.Printf("FATAL: leaked resources, got: %+v", err)
-				return err
-			}
+	d.closeConns()
+	var errs cleanupErrors
+
+	for _, node := range d.nodes {
+		if node.container() == "" {
+			continue
 		}
+		log.Printf("removing container %q", node.container())
+		errs.add("removing container "+node.name, d.c.ContainerRemove(
+			ctx,
+			node.container(),
+			types.ContainerRemoveOptions{
+				RemoveVolumes: true,
+				Force:         true,
+			}))
 	}
 
-	if d.toxi != nil {
-		if err := d.toxi.Cleanup(ctx); err != nil {
-			return err
+	for _, toxi := range d.sidecars() {
+		errs.add("removing toxiproxy", toxi.Cleanup(ctx))
+	}
+
+	for _, node := range d.nodes {
+		if node.storeVolume != "" {
+			log.Printf("removing volume %q", node.storeVolume)
+			errs.add("removing volume "+node.storeVolume, d.c.VolumeRemove(ctx, node.storeVolume, true))
 		}
 	}
 
 	if d.networkID != "" {
 		log.Printf("removing network %q", d.networkID)
-		if err := d.c.NetworkRemove(ctx, d.networkID); err != nil {
-			log.Printf("FATAL: leaked resources, got: %+v", err)
-			return err
-		}
+		errs.add("removing network "+d.networkID, d.c.NetworkRemove(ctx, d.networkID))
 	}
 
-	return nil
+	if d.certs != nil {
+		errs.add("removing certificates", d.certs.cleanup())
+	}
+
+	if d.slot != nil {
+		errs.add("releasing slot", d.slot.Close())
+		d.slot = nil
+	}
+
+	return errs.err()
 }
 
-func (d *DockerCluster) addNode(ctx context.Context, name string, joinNodeName string) (string, error) {
-	cmd := []string{"start", "--insecure"}
-	bindings := make(nat.PortMap)
-
-	if joinNodeName != "" {
-		// All nodes that aren not first will join the cluster.
-		if d.settings.SetupToxiproxy {
-			proxyAddr := d.proxies[joinNodeName].Listen
-			cmd = append(cmd, fmt.Sprintf("--join=%s", proxyAddr))
-		} else {
-			cmd = append(cmd, fmt.Sprintf("--join=%s", joinNodeName))
-		}
-	} else {
-		// Bind ports for the first node.
-		// FIXME(joey): Use a random, free port. Even better, reserve or
-		// pre-acquire the port so there is no race condition to acquire it.
-		// This is probably a hard problem though (transferring port to
-		// another process, with Go).
-		openPort, err := freeport.GetFreePort()
-		if err != nil {
-			return "", err
-		}
-		bindings["26257/tcp"] = []nat.PortBinding{nat.PortBinding{HostPort: strconv.Itoa(openPort)}}
-		d.dbPort = openPort
+func (d *DockerCluster) nodeName(id NodeID) string {
+	return fmt.Sprintf("%s-%d", d.dockerConfig.NamePrefix, id)
+}
 
-		openPort, err = freeport.GetFreePort()
-		if err != nil {
-			return "", err
-		}
-		bindings["8080/tcp"] = []nat.PortBinding{nat.PortBinding{HostPort: strconv.Itoa(openPort)}}
-		d.adminPort = openPort
-		log.Printf("cluster available at admin=%d database=%d", d.adminPort, d.dbPort)
+// joinAddr is the address other nodes use to reach the node.
+func (d *DockerCluster) joinAddr(id NodeID) string {
+	if d.settings.SetupToxiproxy {
+		return fmt.Sprintf("%s:%d", linkHost, linkPort(id))
 	}
+	return d.nodeName(id)
+}
 
-	if d.settings.SetupToxiproxy {
-		proxy, err := d.toxi.AddProxy(name, "", fmt.Sprintf("%s:%d", name, 26257))
-		if err != nil {
-			return "", err
-		}
-		d.proxies[name] = proxy
-		host, port, err := net.SplitHostPort(proxy.Listen)
-		if err != nil {
-			return "", err
-		}
-		advertiseHostStr := fmt.Sprintf("--advertise-host=%s", host)
-		advertisePortStr := fmt.Sprintf("--advertise-port=%s", port)
-		cmd = append(cmd, advertiseHostStr, advertisePortStr)
+// createContainer creates a container of the node with the spec, which
+// becomes its current container.
+func (d *DockerCluster) createContainer(ctx context.Context, node *dockerNode, spec NodeSpec) error {
+	// Every node gets its ports published, so that it can be used as a
+	// gateway and its health can be checked from the outside. Docker picks
+	// the host ports when the container starts, see readPorts.
+	bindings := nat.PortMap{
+		sqlPort:   []nat.PortBinding{{}},
+		adminPort: []nat.PortBinding{{}},
+	}
+	binds := spec.binds()
+	if node.storeVolume != "" {
+		binds = append(binds, fmt.Sprintf("%s:%s", node.storeVolume, defaultStoreDir))
 	}
 
 	endpoints := make(map[string]*network.EndpointSettings, 1)
 	endpoints[d.dockerConfig.NetworkName] = &network.EndpointSettings{}
 
-	log.Printf("creating cockroachdb node container %q", name)
+	d.mu.Lock()
+	resources := node.resources
+	d.mu.Unlock()
+
+	log.Printf("creating cockroachdb node container %q", node.name)
 	resp, err := d.c.ContainerCreate(
 		ctx,
 		&container.Config{
-			Image:    d.dockerConfig.ImageWithTag(),
-			Hostname: name,
-			Cmd:      cmd,
+			Image:    spec.imageWithTag(),
+			Hostname: node.name,
+			Cmd:      node.cmd,
+			Env:      spec.Env,
+			Labels:   d.containerLabels(nodeLabel, node.id),
 			// FIXME(joey): May not need this, if the Dockerfile is correct.
 			ExposedPorts: nat.PortSet{
-				"8080/tcp":  struct{}{},
-				"26257/tcp": struct{}{},
+				adminPort: struct{}{},
+				sqlPort:   struct{}{},
 			},
 		},
 		&container.HostConfig{
@@ -233,61 +360,127 @@ func (d *DockerCluster) addNode(ctx context.Context, name string, joinNodeName s
 			// impact yet.
 			NetworkMode:  container.NetworkMode(d.dockerConfig.NetworkName),
 			PortBindings: bindings,
+			ExtraHosts:   node.extraHosts,
+			Binds:        binds,
+			Tmpfs:        spec.Tmpfs,
+			Resources:    resources.container(),
 		},
 		&network.NetworkingConfig{
 			EndpointsConfig: endpoints,
 		},
-		name,
+		node.name,
 	)
 	if err != nil {
-		return "", err
+		return err
 	}
 	for _, warning := range resp.Warnings {
 		log.Printf("warning: %s", warning)
 	}
-	return resp.ID, nil
-}
+	d.mu.Lock()
+	node.containerID = resp.ID
+	d.mu.Unlock()
+	d.setStatus(node, host.Created)
 
-func (d *DockerCluster) Start(ctx context.Context) error {
-	for _, containerID := range d.containerIDs {
-		log.Printf("starting container %q", containerID)
-		if err := d.c.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+	if d.certs != nil {
+		if err := d.copyNodeCerts(ctx, node); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (d *DockerCluster) GetConnection(ctx context.Context, database string) (*sql.DB, error) {
-	if d.conn != nil {
-		return d.conn, nil
+// addNode adds the node to the cluster, and creates its sidecar, store
+// volume and container.
+func (d *DockerCluster) addNode(ctx context.Context, id NodeID, l locality) error {
+	name := d.nodeName(id)
+	start, join := d.startCommand(id)
+	cmd := []string{start, d.securityFlag()}
+	spec := d.nodeSpec(id)
+	node := &dockerNode{d: d, id: id, name: name, locality: l, spec: spec, resources: spec.Resources}
+	d.nodes = append(d.nodes, node)
+
+	if len(join) > 0 {
+		addrs := make([]string, 0, len(join))
+		for _, joinID := range join {
+			addrs = append(addrs, d.joinAddr(joinID))
+		}
+		cmd = append(cmd, fmt.Sprintf("--join=%s", strings.Join(addrs, ",")))
+	}
+	if l.region != "" {
+		cmd = append(cmd, fmt.Sprintf("--locality=%s", l))
 	}
 
-	var databaseStr string
-	if database != "" {
-		databaseStr = "/" + database
+	var extraHosts []string
+	if d.settings.SetupToxiproxy {
+		if err := d.addSidecar(ctx, node); err != nil {
+			return err
+		}
+		extraHosts = append(extraHosts, fmt.Sprintf("%s:%s", linkHost, node.toxiIP))
+		advertiseHostStr := fmt.Sprintf("--advertise-host=%s", linkHost)
+		advertisePortStr := fmt.Sprintf("--advertise-port=%d", linkPort(id))
+		cmd = append(cmd, advertiseHostStr, advertisePortStr)
 	}
-	connStr := fmt.Sprintf(
-		"postgres://root@localhost:%d%s?application_name=%s&sslmode=disable",
-		d.dbPort,
-		databaseStr,
-		applicationName,
-	)
-	// Attempt to connect to the container, with an exponential backoff.
-	err := backoff.Retry(func() error {
-		var err error
-		d.conn, err = sql.Open("postgres", connStr)
-		if err != nil {
+	if spec.Store != "" {
+		cmd = append(cmd, fmt.Sprintf("--store=%s", spec.Store))
+	} else if _, ok := spec.Volumes[defaultStoreDir]; !ok {
+		volume := fmt.Sprintf("%s-data", name)
+		log.Printf("creating store volume %q", volume)
+		if _, err := d.c.VolumeCreate(ctx, volumetypes.VolumesCreateBody{
+			Name:   volume,
+			Labels: d.labels,
+		}); err != nil {
+			return err
+		}
+		node.storeVolume = volume
+	}
+	node.cmd = append(cmd, spec.Flags...)
+	node.extraHosts = extraHosts
+
+	return d.createContainer(ctx, node, spec)
+}
+
+// Start starts all node containers and waits for the cluster to become
+// ready. See WaitUntil for what ready means. It then applies the cluster
+// settings, zone config and bootstrap SQL of the settings.
+func (d *DockerCluster) Start(ctx context.Context) error {
+	for _, node := range d.nodes {
+		log.Printf("starting container %q", node.container())
+		if err := d.c.ContainerStart(ctx, node.container(), types.ContainerStartOptions{}); err != nil {
 			return err
 		}
-		if err := d.conn.PingContext(ctx); err != nil {
+		d.setStatus(node, host.Starting)
+		if err := d.readPorts(ctx, node); err != nil {
 			return err
 		}
-		return nil
-	}, backoff.WithContext(backoff.NewExponentialBackOff(), ctx))
+	}
+	if d.bootstrap == BootstrapInit {
+		if err := d.initCluster(ctx); err != nil {
+			return err
+		}
+	}
+	if err := d.WaitUntil(ctx, host.Running); err != nil {
+		return err
+	}
+	for _, node := range d.nodes {
+		d.setStatus(node, host.Running)
+	}
+	return d.applySetup(ctx)
+}
 
+// readPorts reads back the host ports that Docker published the node on.
+// They change every time the container starts.
+func (d *DockerCluster) readPorts(ctx context.Context, node *dockerNode) error {
+	adminHost, err := host.DockerHostPort(ctx, d.c, node.container(), adminPort)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return d.conn, nil
+	sqlHost, err := host.DockerHostPort(ctx, d.c, node.container(), sqlPort)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	node.adminPort, node.sqlPort = adminHost, sqlHost
+	d.mu.Unlock()
+	log.Printf("node %q available at admin=%d database=%d", node.name, adminHost, sqlHost)
+	return nil
 }
@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/lego/roachnest/pkg/cluster/tools"
+)
+
+// When toxiproxy is set up, every node gets its own toxiproxy sidecar
+// that carries all of the node's outbound traffic to other nodes. The
+// sidecar of node i has one proxy per node j, the link i->j, listening
+// on linkPort(j).
+//
+// Every node advertises linkHost:linkPort(self), and each node container
+// resolves linkHost to its own sidecar. So node i reaches node j only
+// through the link i->j, and each directed pair of nodes can be faulted
+// on its own.
+const (
+	linkHost     = "roachnest-link"
+	linkBasePort = 26300
+)
+
+// With ProxyClients, the SQL connections of the test go through a
+// toxiproxy of their own. It has one proxy per gateway node j, the link
+// Client->j, listening on linkPort(j) and published on the host.
+//
+// Client stands for the SQL clients of the test, as the From of a Link.
+// Link{From: Client, To: n} carries client connections to gateway n.
+const Client NodeID = -1
+
+// Link is the directed network path from one node to another. It
+// carries the connections that From opens to To.
+type Link struct {
+	From NodeID
+	To   NodeID
+}
+
+func (l Link) String() string {
+	return fmt.Sprintf("%s->%s", l.From, l.To)
+}
+
+func (l Link) proxyName() string {
+	return fmt.Sprintf("%s-%s", l.From, l.To)
+}
+
+func linkPort(to NodeID) int {
+	return linkBasePort + int(to)
+}
+
+// addSidecar creates and starts the toxiproxy sidecar of the node, and
+// the links from the node to every node in the cluster.
+func (d *DockerCluster) addSidecar(ctx context.Context, node *dockerNode) error {
+	toxi, err := tools.NewDockerToxiproxy(ctx, d.c, tools.DockerToxiproxyConfig{
+		Name:        d.toxiName(node.id),
+		NetworkName: d.dockerConfig.NetworkName,
+		Labels:      d.containerLabels(toxiLabel, node.id),
+	})
+	if err != nil {
+		return err
+	}
+	node.toxi = toxi
+	if err := toxi.Start(ctx); err != nil {
+		return err
+	}
+	if node.toxiIP, err = toxi.IPAddress(ctx); err != nil {
+		return err
+	}
+
+	for to := 0; to < d.settings.Size; to++ {
+		l := Link{From: node.id, To: NodeID(to)}
+		proxy, err := toxi.AddProxy(
+			l.proxyName(),
+			fmt.Sprintf("0.0.0.0:%d", linkPort(l.To)),
+			fmt.Sprintf("%s:%d", d.nodeName(l.To), 26257),
+		)
+		if err != nil {
+			return err
+		}
+		d.links[l] = proxy
+	}
+	return nil
+}
+
+// addClientSidecar creates and starts the toxiproxy carrying client
+// connections, and the links from the clients to every node.
+func (d *DockerCluster) addClientSidecar(ctx context.Context) error {
+	ports := make([]int, 0, d.settings.Size)
+	for to := 0; to < d.settings.Size; to++ {
+		ports = append(ports, linkPort(NodeID(to)))
+	}
+	toxi, err := tools.NewDockerToxiproxy(ctx, d.c, tools.DockerToxiproxyConfig{
+		Name:        d.toxiName(Client),
+		NetworkName: d.dockerConfig.NetworkName,
+		Ports:       ports,
+		Labels:      d.containerLabels(toxiLabel, Client),
+	})
+	if err != nil {
+		return err
+	}
+	d.clientToxi = toxi
+	if err := toxi.Start(ctx); err != nil {
+		return err
+	}
+
+	for to := 0; to < d.settings.Size; to++ {
+		l := Link{From: Client, To: NodeID(to)}
+		proxy, err := toxi.AddProxy(
+			l.proxyName(),
+			fmt.Sprintf("0.0.0.0:%d", linkPort(l.To)),
+			fmt.Sprintf("%s:%d", d.nodeName(l.To), 26257),
+		)
+		if err != nil {
+			return err
+		}
+		d.links[l] = proxy
+	}
+	return nil
+}
+
+// sidecars returns every toxiproxy of the cluster.
+func (d *DockerCluster) sidecars() []*tools.DockerToxiproxy {
+	var sidecars []*tools.DockerToxiproxy
+	for _, node := range d.nodes {
+		if node.toxi != nil {
+			sidecars = append(sidecars, node.toxi)
+		}
+	}
+	if d.clientToxi != nil {
+		sidecars = append(sidecars, d.clientToxi)
+	}
+	return sidecars
+}
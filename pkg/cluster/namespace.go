@@ -0,0 +1,118 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+)
+
+// Every cluster is namespaced by its run ID, so that clusters created
+// with the same DockerConfig, e.g. by tests running in parallel, do not
+// conflict. The run ID is appended to the network name and to the name
+// prefix of every container.
+func namespace(config DockerConfig, runID string) DockerConfig {
+	config.NetworkName = fmt.Sprintf("%s-%s", config.NetworkName, runID)
+	config.NamePrefix = fmt.Sprintf("%s-%s", config.NamePrefix, runID)
+	return config
+}
+
+// toxiName is the name of the toxiproxy container of the node, or of the
+// client toxiproxy for Client.
+func (d *DockerCluster) toxiName(id NodeID) string {
+	if id == Client {
+		return fmt.Sprintf("%s-toxi-client", d.dockerConfig.NamePrefix)
+	}
+	return fmt.Sprintf("%s-toxi-%d", d.dockerConfig.NamePrefix, id)
+}
+
+// The network of each cluster gets its own /24 subnet out of the /16
+// subnetPool, so that clusters never overlap, and so that they do not
+// exhaust the small default address pools of Docker.
+const (
+	subnetPool = "10.213.0.0/16"
+	// subnetAttempts bounds the retries when another process takes the
+	// same subnet between listing the networks and creating ours.
+	subnetAttempts = 5
+)
+
+// createNetwork creates the network of the cluster on a subnet that no
+// other Docker network uses.
+func (d *DockerCluster) createNetwork(ctx context.Context) error {
+	labels, err := d.networkLabels()
+	if err != nil {
+		return err
+	}
+	var lastErr error
+	for attempt := 0; attempt < subnetAttempts; attempt++ {
+		subnet, err := d.freeSubnet(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("creating network %q on %s", d.dockerConfig.NetworkName, subnet)
+		resp, err := d.c.NetworkCreate(ctx,
+			d.dockerConfig.NetworkName,
+			types.NetworkCreate{
+				Driver: "bridge",
+				IPAM: &network.IPAM{
+					Config: []network.IPAMConfig{{Subnet: subnet.String()}},
+				},
+				Labels: labels,
+			},
+		)
+		if err == nil {
+			d.networkID = resp.ID
+			return nil
+		}
+		if !strings.Contains(err.Error(), "overlaps") {
+			return err
+		}
+		lastErr = err
+	}
+	return lastErr
+}
+
+// freeSubnet returns the first subnet of subnetPool that does not
+// overlap the subnet of any Docker network.
+func (d *DockerCluster) freeSubnet(ctx context.Context) (*net.IPNet, error) {
+	networks, err := d.c.NetworkList(ctx, types.NetworkListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var used []*net.IPNet
+	for _, n := range networks {
+		for _, config := range n.IPAM.Config {
+			if _, subnet, err := net.ParseCIDR(config.Subnet); err == nil {
+				used = append(used, subnet)
+			}
+		}
+	}
+
+	_, pool, err := net.ParseCIDR(subnetPool)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 256; i++ {
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, pool.IP.To4())
+		ip[2] = byte(i)
+		candidate := &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}
+		if !overlapsAny(candidate, used) {
+			return candidate, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left in %s", subnetPool)
+}
+
+func overlapsAny(subnet *net.IPNet, others []*net.IPNet) bool {
+	for _, other := range others {
+		if subnet.Contains(other.IP) || other.Contains(subnet.IP) {
+			return true
+		}
+	}
+	return false
+}
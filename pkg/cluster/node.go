@@ -0,0 +1,272 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/moby/moby/client"
+
+	"github.com/lego/roachnest/pkg/host"
+)
+
+// stopTimeout is how long a node has to shut down after SIGTERM before
+// it is killed.
+const stopTimeout = 10 * time.Second
+
+func (d *DockerCluster) node(id NodeID) (*dockerNode, error) {
+	if id < 0 || int(id) >= len(d.nodes) {
+		return nil, fmt.Errorf("no node n%d in a cluster of %d nodes", id, len(d.nodes))
+	}
+	return d.nodes[id], nil
+}
+
+// Node returns the node with the ID. It panics if there is no such node,
+// like indexing a slice.
+func (d *DockerCluster) Node(id NodeID) Node {
+	node, err := d.node(id)
+	if err != nil {
+		panic(err)
+	}
+	return node
+}
+
+func (n *dockerNode) ID() NodeID {
+	return n.id
+}
+
+func (n *dockerNode) Name() string {
+	return n.name
+}
+
+// SQLAddr is the host address for SQL clients to reach the node at. With
+// ProxyClients, it goes through the link from the clients to the node.
+func (n *dockerNode) SQLAddr() string {
+	port, err := n.clientPort()
+	if err != nil {
+		// The client proxies are published before the cluster is
+		// returned, so this cannot happen.
+		panic(err)
+	}
+	return fmt.Sprintf("localhost:%d", port)
+}
+
+// AdminURL is the URL of the admin UI and HTTP API of the node. It is
+// served over HTTPS in secure mode.
+func (n *dockerNode) AdminURL() string {
+	scheme := "http"
+	if n.d.settings.Secure {
+		scheme = "https"
+	}
+	_, admin := n.ports()
+	return fmt.Sprintf("%s://localhost:%d", scheme, admin)
+}
+
+// container returns the ID of the current container of the node.
+func (n *dockerNode) container() string {
+	n.d.mu.Lock()
+	defer n.d.mu.Unlock()
+	return n.containerID
+}
+
+// currentSpec returns the spec of the current container of the node.
+func (n *dockerNode) currentSpec() NodeSpec {
+	n.d.mu.Lock()
+	defer n.d.mu.Unlock()
+	return n.spec
+}
+
+// ports returns the host ports of the node, for SQL and the admin UI.
+func (n *dockerNode) ports() (sqlPort, adminPort int) {
+	n.d.mu.Lock()
+	defer n.d.mu.Unlock()
+	return n.sqlPort, n.adminPort
+}
+
+// clientPort is the host port for SQL clients to reach the node at.
+func (n *dockerNode) clientPort() (int, error) {
+	if n.d.settings.ProxyClients {
+		return n.d.clientToxi.HostPort(linkPort(n.id))
+	}
+	port, _ := n.ports()
+	return port, nil
+}
+
+func (d *DockerCluster) setStatus(node *dockerNode, status host.Status) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	log.Printf("node %q is %s", node.name, status)
+	node.status = status
+}
+
+func (d *DockerCluster) getStatus(node *dockerNode) host.Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return node.status
+}
+
+// Nodes reports the status of every node. The status tracked by the
+// cluster is reconciled with the state of the container, so nodes that
+// died on their own are reported as stopped.
+func (d *DockerCluster) Nodes(ctx context.Context) ([]NodeInfo, error) {
+	infos := make([]NodeInfo, 0, len(d.nodes))
+	for _, node := range d.nodes {
+		status := d.getStatus(node)
+		var oomKilled bool
+		info, err := d.c.ContainerInspect(ctx, node.container())
+		if client.IsErrContainerNotFound(err) {
+			status = host.Deleted
+		} else if err != nil {
+			return nil, err
+		} else {
+			status = observedStatus(info.State, status)
+			oomKilled = !info.State.Running && info.State.OOMKilled
+		}
+		infos = append(infos, NodeInfo{
+			ID:        node.id,
+			Name:      node.name,
+			Status:    status,
+			Locality:  node.locality.String(),
+			OOMKilled: oomKilled,
+		})
+	}
+	return infos, nil
+}
+
+func observedStatus(state *types.ContainerState, tracked host.Status) host.Status {
+	switch {
+	case state.Paused:
+		return host.Paused
+	case state.Running:
+		if tracked == host.Starting || tracked == host.Stopping {
+			return tracked
+		}
+		return host.Running
+	case tracked == host.Created:
+		return host.Created
+	}
+	return host.Stopped
+}
+
+func (d *DockerCluster) DrainNode(ctx context.Context, id NodeID) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	return d.drain(ctx, node)
+}
+
+// drain drains the node, which is Stopping meanwhile. It is back to its
+// previous status afterwards, as a drained node keeps running.
+func (d *DockerCluster) drain(ctx context.Context, node *dockerNode) error {
+	previous := d.getStatus(node)
+	d.setStatus(node, host.Stopping)
+	defer d.setStatus(node, previous)
+	log.Printf("draining node %q", node.name)
+	_, err := host.DockerExec(ctx, d.c, node.container(), []string{
+		"/cockroach/cockroach", "node", "drain", d.securityFlag(), "--host=localhost:26257",
+	})
+	return err
+}
+
+func (d *DockerCluster) StopNode(ctx context.Context, id NodeID) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	if err := d.drain(ctx, node); err != nil {
+		return err
+	}
+	return d.stop(ctx, node)
+}
+
+func (d *DockerCluster) stop(ctx context.Context, node *dockerNode) error {
+	d.setStatus(node, host.Stopping)
+	log.Printf("stopping container %q", node.container())
+	timeout := stopTimeout
+	if err := d.c.ContainerStop(ctx, node.container(), &timeout); err != nil {
+		return err
+	}
+	d.setStatus(node, host.Stopped)
+	return nil
+}
+
+func (d *DockerCluster) KillNode(ctx context.Context, id NodeID) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("killing container %q", node.container())
+	if err := d.c.ContainerKill(ctx, node.container(), "SIGKILL"); err != nil {
+		return err
+	}
+	d.setStatus(node, host.Stopped)
+	return nil
+}
+
+func (d *DockerCluster) PauseNode(ctx context.Context, id NodeID) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("pausing container %q", node.container())
+	if err := d.c.ContainerPause(ctx, node.container()); err != nil {
+		return err
+	}
+	d.setStatus(node, host.Paused)
+	return nil
+}
+
+func (d *DockerCluster) UnpauseNode(ctx context.Context, id NodeID) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	log.Printf("unpausing container %q", node.container())
+	if err := d.c.ContainerUnpause(ctx, node.container()); err != nil {
+		return err
+	}
+	d.setStatus(node, host.Running)
+	return nil
+}
+
+// RestartNode stops the node, if it is running, and starts the same
+// container again. The default store lives in the volume of the node,
+// so it survives the restart, unlike a Store of the spec in memory.
+func (d *DockerCluster) RestartNode(ctx context.Context, id NodeID) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+
+	info, err := d.c.ContainerInspect(ctx, node.container())
+	if err != nil {
+		return err
+	}
+	if info.State.Paused {
+		if err := d.UnpauseNode(ctx, id); err != nil {
+			return err
+		}
+	}
+	if info.State.Running {
+		if err := d.stop(ctx, node); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("starting container %q", node.container())
+	if err := d.c.ContainerStart(ctx, node.container(), types.ContainerStartOptions{}); err != nil {
+		return err
+	}
+	d.setStatus(node, host.Starting)
+	if err := d.readPorts(ctx, node); err != nil {
+		return err
+	}
+	if err := d.waitReady(ctx, []*dockerNode{node}, false); err != nil {
+		return err
+	}
+	d.setStatus(node, host.Running)
+	return nil
+}
@@ -0,0 +1,157 @@
+package cluster
+
+import (
+	"fmt"
+
+	"github.com/docker/docker/api/types/blkiodev"
+	"github.com/docker/docker/api/types/container"
+)
+
+// NodeSpec configures how a node is started. Settings.DefaultNode
+// applies to every node, and Settings.Nodes overrides it for some nodes,
+// see merge.
+type NodeSpec struct {
+	// Flags are added to the cockroach start command, e.g. --cache=.25.
+	Flags []string
+	// Env holds KEY=value variables for the cockroach process.
+	Env []string
+	// Store is the value of --store, e.g. type=mem,size=1GiB. It defaults
+	// to a store in the volume of the node.
+	Store string
+
+	// Tmpfs mounts a tmpfs at each container path, with the options.
+	Tmpfs map[string]string
+	// Volumes mounts a named Docker volume at each container path.
+	Volumes map[string]string
+
+	// Image and Tag override the DockerConfig of the cluster.
+	Image string
+	Tag   string
+
+	Resources Resources
+}
+
+// Resources limits what a node can use on the host. Zero values mean no
+// limit.
+type Resources struct {
+	// CPUs is the number of CPUs, e.g. 0.5 for half of one.
+	CPUs float64
+	// Memory is the memory limit in bytes.
+	Memory int64
+	// BlkioWeight is the relative block IO weight, from 10 to 1000.
+	BlkioWeight uint16
+	// DeviceReadBps and DeviceWriteBps limit the IO bandwidth to host
+	// devices, in bytes per second by device path, e.g. /dev/sda.
+	DeviceReadBps  map[string]uint64
+	DeviceWriteBps map[string]uint64
+}
+
+// merge returns the spec with the overrides applied. Flags and env are
+// appended, tmpfs and volumes are merged, and everything else is
+// replaced when it is set in the overrides.
+func (s NodeSpec) merge(o NodeSpec) NodeSpec {
+	merged := s
+	merged.Flags = append(append([]string(nil), s.Flags...), o.Flags...)
+	merged.Env = append(append([]string(nil), s.Env...), o.Env...)
+	merged.Tmpfs = mergeMaps(s.Tmpfs, o.Tmpfs)
+	merged.Volumes = mergeMaps(s.Volumes, o.Volumes)
+	if o.Store != "" {
+		merged.Store = o.Store
+	}
+	if o.Image != "" {
+		merged.Image = o.Image
+	}
+	if o.Tag != "" {
+		merged.Tag = o.Tag
+	}
+
+	r := &merged.Resources
+	if o.Resources.CPUs != 0 {
+		r.CPUs = o.Resources.CPUs
+	}
+	if o.Resources.Memory != 0 {
+		r.Memory = o.Resources.Memory
+	}
+	if o.Resources.BlkioWeight != 0 {
+		r.BlkioWeight = o.Resources.BlkioWeight
+	}
+	if o.Resources.DeviceReadBps != nil {
+		r.DeviceReadBps = o.Resources.DeviceReadBps
+	}
+	if o.Resources.DeviceWriteBps != nil {
+		r.DeviceWriteBps = o.Resources.DeviceWriteBps
+	}
+	return merged
+}
+
+func mergeMaps(a, b map[string]string) map[string]string {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// nodeSpec returns the spec of a node, with the image of the cluster
+// unless the spec has its own.
+func (d *DockerCluster) nodeSpec(id NodeID) NodeSpec {
+	spec := d.settings.DefaultNode.merge(d.settings.Nodes[id])
+	if spec.Image == "" {
+		spec.Image = d.dockerConfig.Image
+	}
+	if spec.Tag == "" {
+		spec.Tag = d.dockerConfig.Tag
+	}
+	return spec
+}
+
+func (s NodeSpec) imageWithTag() string {
+	return fmt.Sprintf("%s:%s", s.Image, s.Tag)
+}
+
+// binds returns the volume bindings of the spec, in Docker's name:path
+// form.
+func (s NodeSpec) binds() []string {
+	var binds []string
+	for path, volume := range s.Volumes {
+		binds = append(binds, fmt.Sprintf("%s:%s", volume, path))
+	}
+	return binds
+}
+
+// cpuPeriod is the CFS period that CPU limits are a quota of.
+const cpuPeriod = 100000
+
+func (r Resources) container() container.Resources {
+	// CPUs are set as a quota rather than NanoCPUs, since only a quota can
+	// be lifted again by UpdateResources.
+	var quota, period int64
+	if r.CPUs != 0 {
+		quota, period = int64(r.CPUs*cpuPeriod), cpuPeriod
+	}
+	// Swap is limited to the memory limit, i.e. none, so that a node that
+	// runs out of memory is OOM killed rather than slowed down by swap.
+	return container.Resources{
+		CPUPeriod:           period,
+		CPUQuota:            quota,
+		Memory:              r.Memory,
+		MemorySwap:          r.Memory,
+		BlkioWeight:         r.BlkioWeight,
+		BlkioDeviceReadBps:  throttleDevices(r.DeviceReadBps),
+		BlkioDeviceWriteBps: throttleDevices(r.DeviceWriteBps),
+	}
+}
+
+func throttleDevices(rates map[string]uint64) []*blkiodev.ThrottleDevice {
+	var devices []*blkiodev.ThrottleDevice
+	for path, rate := range rates {
+		devices = append(devices, &blkiodev.ThrottleDevice{Path: path, Rate: rate})
+	}
+	return devices
+}
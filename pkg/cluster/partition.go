@@ -0,0 +1,139 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	toxiproxy "github.com/Shopify/toxiproxy/client"
+)
+
+var errNoToxiproxy = errors.New("cluster was not created with SetupToxiproxy or ProxyClients")
+
+// A cut link blackholes data in both directions with timeout toxics that
+// never fire. Connections stay open but nothing gets through, as with a
+// real network partition.
+var partitionToxics = map[string]string{
+	"partition-upstream":   "upstream",
+	"partition-downstream": "downstream",
+}
+
+// Partition splits the cluster so that nodes in different groups cannot
+// reach each other. Nodes that are not in any group can still reach,
+// and be reached by, every node. Partitions add up until Heal.
+func (d *DockerCluster) Partition(ctx context.Context, groups ...[]NodeID) error {
+	if !d.settings.SetupToxiproxy {
+		return errNoToxiproxy
+	}
+
+	groupOf := make(map[NodeID]int)
+	for i, group := range groups {
+		for _, id := range group {
+			if _, err := d.node(id); err != nil {
+				return err
+			}
+			if _, ok := groupOf[id]; ok {
+				return fmt.Errorf("n%d is in more than one group", id)
+			}
+			groupOf[id] = i
+		}
+	}
+
+	log.Printf("partitioning %v", groups)
+	for _, l := range d.sortedLinks() {
+		from, ok := groupOf[l.From]
+		if !ok {
+			continue
+		}
+		to, ok := groupOf[l.To]
+		if !ok || from == to {
+			continue
+		}
+		if err := d.cutLink(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PartitionOneWay stops from reaching to, while to can still reach from.
+func (d *DockerCluster) PartitionOneWay(ctx context.Context, from, to NodeID) error {
+	if !d.settings.SetupToxiproxy {
+		return errNoToxiproxy
+	}
+	for _, id := range []NodeID{from, to} {
+		if _, err := d.node(id); err != nil {
+			return err
+		}
+	}
+	return d.cutLink(Link{From: from, To: to})
+}
+
+// Heal restores every link cut by Partition or PartitionOneWay.
+func (d *DockerCluster) Heal(ctx context.Context) error {
+	if !d.settings.SetupToxiproxy {
+		return errNoToxiproxy
+	}
+	log.Printf("healing all partitions")
+	for _, l := range d.sortedLinks() {
+		if err := d.healLink(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DockerCluster) cutLink(l Link) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cut[l] {
+		return nil
+	}
+
+	log.Printf("cutting link %s", l)
+	proxy := d.links[l]
+	for name, stream := range partitionToxics {
+		if _, err := proxy.AddToxic(name, "timeout", stream, 1, toxiproxy.Attributes{
+			"timeout": 0,
+		}); err != nil {
+			return err
+		}
+	}
+	d.cut[l] = true
+	return nil
+}
+
+func (d *DockerCluster) healLink(l Link) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.cut[l] {
+		return nil
+	}
+
+	log.Printf("healing link %s", l)
+	proxy := d.links[l]
+	for name := range partitionToxics {
+		if err := proxy.RemoveToxic(name); err != nil {
+			return err
+		}
+	}
+	delete(d.cut, l)
+	return nil
+}
+
+// sortedLinks returns every link in the cluster, in a stable order.
+func (d *DockerCluster) sortedLinks() []Link {
+	links := make([]Link, 0, len(d.links))
+	for l := range d.links {
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].From != links[j].From {
+			return links[i].From < links[j].From
+		}
+		return links[i].To < links[j].To
+	})
+	return links
+}
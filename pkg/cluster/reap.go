@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/moby/moby/client"
+)
+
+// Every container, network and volume of a cluster is labeled, so that
+// the ones left behind can be found and reaped.
+const (
+	// runLabel is a random ID of the cluster, set on all of its resources.
+	runLabel = "roachnest.run"
+	// ownerLabel is user@host of the process that created the cluster,
+	// and pidLabel its process ID.
+	ownerLabel = "roachnest.owner"
+	pidLabel   = "roachnest.pid"
+	// createdLabel is when the cluster was created, in RFC 3339.
+	createdLabel = "roachnest.created"
+	// clusterLabel is the name of the cluster, see Attach.
+	clusterLabel = "roachnest.cluster"
+	// detachedLabel is set on the resources of Detached clusters.
+	detachedLabel = "roachnest.detached"
+
+	// nodeLabel is the ID of the node of a node container, and toxiLabel
+	// the ID of the node of a toxiproxy container, or of Client.
+	nodeLabel = "roachnest.node"
+	toxiLabel = "roachnest.toxi"
+	// stateLabel of the network holds what Attach needs to know of the
+	// cluster besides its Docker resources.
+	stateLabel = "roachnest.state"
+)
+
+// cleanupTimeout bounds the rollback of a cluster that failed to be
+// created, which cannot use the context of the creation as it may be
+// done.
+const cleanupTimeout = time.Minute
+
+// CleanupError gathers every error of a best-effort cleanup.
+type CleanupError struct {
+	Errs []error
+}
+
+func (e *CleanupError) Error() string {
+	msgs := make([]string, 0, len(e.Errs))
+	for _, err := range e.Errs {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("leaked resources: %s", strings.Join(msgs, "; "))
+}
+
+// cleanupErrors collects errors, for cleanups that keep going after one.
+type cleanupErrors []error
+
+func (errs *cleanupErrors) add(what string, err error) {
+	if err != nil {
+		log.Printf("FATAL: leaked resources, got: %+v", err)
+		*errs = append(*errs, fmt.Errorf("%s: %v", what, err))
+	}
+}
+
+func (errs cleanupErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &CleanupError{Errs: errs}
+}
+
+func newRunID() (string, error) {
+	var b [6]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// ownerLabels returns the labels of every resource of a run of the
+// namespaced config.
+func ownerLabels(runID string, config DockerConfig) map[string]string {
+	owner := "unknown"
+	if u, err := user.Current(); err == nil {
+		owner = u.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		owner = fmt.Sprintf("%s@%s", owner, hostname)
+	}
+	labels := map[string]string{
+		runLabel:     runID,
+		clusterLabel: config.NamePrefix,
+		ownerLabel:   owner,
+		pidLabel:     strconv.Itoa(os.Getpid()),
+		createdLabel: time.Now().UTC().Format(time.RFC3339),
+	}
+	if config.Detached {
+		labels[detachedLabel] = "true"
+	}
+	return labels
+}
+
+// containerLabels returns the labels of the cluster, with key set to the
+// ID of the node.
+func (d *DockerCluster) containerLabels(key string, id NodeID) map[string]string {
+	labels := make(map[string]string, len(d.labels)+1)
+	for k, v := range d.labels {
+		labels[k] = v
+	}
+	labels[key] = strconv.Itoa(int(id))
+	return labels
+}
+
+// orphaned reports whether the labels are of a run created before cutoff
+// by a process that is gone, and not detached from it. Processes on other
+// hosts cannot be checked, so only the age of their runs counts.
+func orphaned(labels map[string]string, cutoff time.Time) bool {
+	if labels[detachedLabel] != "" {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339, labels[createdLabel])
+	if err != nil || created.After(cutoff) {
+		return false
+	}
+	hostname, _ := os.Hostname()
+	if !strings.HasSuffix(labels[ownerLabel], "@"+hostname) {
+		return true
+	}
+	pid, err := strconv.Atoi(labels[pidLabel])
+	if err != nil || pid <= 0 {
+		return true
+	}
+	// Signal 0 only checks that the process exists.
+	err = syscall.Kill(pid, 0)
+	return err != nil && err != syscall.EPERM
+}
+
+// Reap removes the containers, networks and volumes of every roachnest
+// cluster created more than olderThan ago whose creating process is
+// gone, except Detached ones. It keeps going after errors, and returns them together.
+func Reap(ctx context.Context, c *client.Client, olderThan time.Duration) error {
+	cutoff := time.Now().Add(-olderThan)
+	args := filters.NewArgs()
+	args.Add("label", runLabel)
+	var errs cleanupErrors
+
+	containers, err := c.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	errs.add("listing containers", err)
+	for _, container := range containers {
+		if !orphaned(container.Labels, cutoff) {
+			continue
+		}
+		log.Printf("reaping container %q of run %s", container.ID, container.Labels[runLabel])
+		errs.add("removing container "+container.ID, c.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{
+			RemoveVolumes: true,
+			Force:         true,
+		}))
+	}
+
+	networks, err := c.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	errs.add("listing networks", err)
+	for _, network := range networks {
+		if !orphaned(network.Labels, cutoff) {
+			continue
+		}
+		log.Printf("reaping network %q of run %s", network.Name, network.Labels[runLabel])
+		errs.add("removing network "+network.Name, c.NetworkRemove(ctx, network.ID))
+		// The CA key of a secure cluster created on this host.
+		if dir, err := clusterStateDir(network.Labels[clusterLabel]); err == nil {
+			errs.add("removing state of "+network.Name, os.RemoveAll(dir))
+		}
+	}
+
+	volumes, err := c.VolumeList(ctx, args)
+	errs.add("listing volumes", err)
+	for _, volume := range volumes.Volumes {
+		if !orphaned(volume.Labels, cutoff) {
+			continue
+		}
+		log.Printf("reaping volume %q of run %s", volume.Name, volume.Labels[runLabel])
+		errs.add("removing volume "+volume.Name, c.VolumeRemove(ctx, volume.Name, true))
+	}
+	return errs.err()
+}
@@ -0,0 +1,132 @@
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Region is a region of a multi-region cluster. Its nodes are spread over
+// its zones in turn.
+type Region struct {
+	Name  string
+	Zones []string
+	Nodes int
+}
+
+// RegionPair is a pair of regions. Latencies between regions are the
+// same in both directions, so a pair and its reverse are the same.
+type RegionPair struct {
+	A, B string
+}
+
+// MarshalText lets Latencies be encoded as JSON, see Attach.
+func (p RegionPair) MarshalText() ([]byte, error) {
+	return []byte(p.A + "," + p.B), nil
+}
+
+func (p *RegionPair) UnmarshalText(text []byte) error {
+	parts := strings.SplitN(string(text), ",", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid region pair %q", text)
+	}
+	p.A, p.B = parts[0], parts[1]
+	return nil
+}
+
+// locality is where a node is placed in a multi-region cluster.
+type locality struct {
+	region string
+	zone   string
+}
+
+// String is the value of the --locality flag of the node.
+func (l locality) String() string {
+	if l.region == "" {
+		return ""
+	}
+	tiers := []string{fmt.Sprintf("region=%s", l.region)}
+	if l.zone != "" {
+		tiers = append(tiers, fmt.Sprintf("zone=%s", l.zone))
+	}
+	return strings.Join(tiers, ",")
+}
+
+// placeNodes checks the regions of the settings, and returns the
+// locality of every node. With regions, Size may be left unset and is
+// set to the number of nodes in all regions.
+func placeNodes(settings *Settings) ([]locality, error) {
+	if len(settings.Regions) == 0 {
+		if len(settings.Latencies) > 0 {
+			return nil, errors.New("Latencies are set without Regions")
+		}
+		return make([]locality, settings.Size), nil
+	}
+
+	regions := make(map[string]bool, len(settings.Regions))
+	var localities []locality
+	for _, region := range settings.Regions {
+		if regions[region.Name] {
+			return nil, fmt.Errorf("region %q is declared more than once", region.Name)
+		}
+		regions[region.Name] = true
+		for i := 0; i < region.Nodes; i++ {
+			l := locality{region: region.Name}
+			if len(region.Zones) > 0 {
+				l.zone = region.Zones[i%len(region.Zones)]
+			}
+			localities = append(localities, l)
+		}
+	}
+	if settings.Size != 0 && settings.Size != len(localities) {
+		return nil, fmt.Errorf("Size is %d but the regions have %d nodes", settings.Size, len(localities))
+	}
+	settings.Size = len(localities)
+
+	for pair := range settings.Latencies {
+		for _, name := range []string{pair.A, pair.B} {
+			if !regions[name] {
+				return nil, fmt.Errorf("latency between %s and %s: no region %q", pair.A, pair.B, name)
+			}
+		}
+	}
+	if len(settings.Latencies) > 0 && !settings.SetupToxiproxy {
+		return nil, errors.New("Latencies need SetupToxiproxy")
+	}
+	return localities, nil
+}
+
+// regionLatency returns the round-trip latency between two regions.
+func (s Settings) regionLatency(a, b string) time.Duration {
+	if latency, ok := s.Latencies[RegionPair{A: a, B: b}]; ok {
+		return latency
+	}
+	return s.Latencies[RegionPair{A: b, B: a}]
+}
+
+// addRegionLatencies adds the latency between the regions of every pair
+// of nodes to the links between them. Latency toxics delay data sent one
+// way over a link, so round trips over the link take the latency longer.
+func (d *DockerCluster) addRegionLatencies(ctx context.Context) error {
+	if len(d.settings.Latencies) == 0 {
+		return nil
+	}
+	for _, l := range d.sortedLinks() {
+		if l.From == Client {
+			continue
+		}
+		from, to := d.nodes[l.From].locality, d.nodes[l.To].locality
+		latency := d.settings.regionLatency(from.region, to.region)
+		if latency == 0 {
+			continue
+		}
+		if _, err := d.AddLatency(ctx, l, latency, 0); err != nil {
+			return err
+		}
+	}
+	log.Printf("added latencies between regions: %v", d.settings.Latencies)
+	return nil
+}
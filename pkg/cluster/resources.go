@@ -0,0 +1,92 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// defaultBlkioWeight is the block IO weight of containers without one.
+const defaultBlkioWeight = 500
+
+// OOMKilledError is the reason a node is not ready when the kernel killed
+// it for running out of memory.
+type OOMKilledError struct {
+	ExitCode int
+}
+
+func (e *OOMKilledError) Error() string {
+	return fmt.Sprintf("OOM killed with exit code %d", e.ExitCode)
+}
+
+// UpdateResources replaces the resource limits of a running node. Limits
+// left at zero are lifted, so that the node can use what the host has.
+func (d *DockerCluster) UpdateResources(ctx context.Context, id NodeID, r Resources) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+
+	update := r.container()
+	if r.CPUs == 0 {
+		update.CPUPeriod, update.CPUQuota = cpuPeriod, -1
+	}
+	if r.Memory == 0 {
+		info, err := d.c.Info(ctx)
+		if err != nil {
+			return err
+		}
+		// Swap is lifted with the memory limit, or it could be lower
+		// than it.
+		update.Memory, update.MemorySwap = info.MemTotal, -1
+	}
+	if r.BlkioWeight == 0 {
+		update.BlkioWeight = defaultBlkioWeight
+	}
+	// Devices throttled before but not anymore get a rate of 0, which
+	// lifts the limit.
+	d.mu.Lock()
+	current := node.resources
+	d.mu.Unlock()
+	update.BlkioDeviceReadBps = append(update.BlkioDeviceReadBps,
+		throttleDevices(liftedDevices(current.DeviceReadBps, r.DeviceReadBps))...)
+	update.BlkioDeviceWriteBps = append(update.BlkioDeviceWriteBps,
+		throttleDevices(liftedDevices(current.DeviceWriteBps, r.DeviceWriteBps))...)
+
+	log.Printf("updating resources of node %q to %+v", node.name, r)
+	resp, err := d.c.ContainerUpdate(ctx, node.container(), container.UpdateConfig{Resources: update})
+	if err != nil {
+		return err
+	}
+	for _, warning := range resp.Warnings {
+		log.Printf("warning: %s", warning)
+	}
+
+	d.mu.Lock()
+	node.resources = r
+	d.mu.Unlock()
+	return nil
+}
+
+// RestoreResources puts back the resource limits of the node spec.
+func (d *DockerCluster) RestoreResources(ctx context.Context, id NodeID) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	return d.UpdateResources(ctx, id, node.currentSpec().Resources)
+}
+
+// liftedDevices returns the devices of before that are not in after, with
+// a rate of 0.
+func liftedDevices(before, after map[string]uint64) map[string]uint64 {
+	lifted := make(map[string]uint64)
+	for path := range before {
+		if _, ok := after[path]; !ok {
+			lifted[path] = 0
+		}
+	}
+	return lifted
+}
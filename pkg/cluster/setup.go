@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// settingNameRE matches the names of cluster settings and zone config
+// fields, which are spliced into statements.
+var settingNameRE = regexp.MustCompile(`^[a-z0-9_]+(\.[a-z0-9_]+)*$`)
+
+// applySetup applies the cluster settings, the default zone config and the
+// bootstrap SQL files of the settings, in that order, and logs the values
+// the cluster ended up with.
+func (d *DockerCluster) applySetup(ctx context.Context) error {
+	s := d.settings
+	if len(s.ClusterSettings) == 0 && len(s.DefaultZone) == 0 && len(s.BootstrapSQL) == 0 {
+		return nil
+	}
+	db, err := d.GetConnection(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sortedKeys(s.ClusterSettings) {
+		if !settingNameRE.MatchString(name) {
+			return fmt.Errorf("invalid cluster setting name %q", name)
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			"SET CLUSTER SETTING %s = %s", name, s.ClusterSettings[name],
+		)); err != nil {
+			return fmt.Errorf("setting %s: %v", name, err)
+		}
+		var value string
+		if err := db.QueryRowContext(ctx, fmt.Sprintf("SHOW CLUSTER SETTING %s", name)).Scan(&value); err != nil {
+			return err
+		}
+		log.Printf("cluster setting %s = %s", name, value)
+	}
+
+	if len(s.DefaultZone) > 0 {
+		fields := make([]string, 0, len(s.DefaultZone))
+		for _, name := range sortedKeys(s.DefaultZone) {
+			if !settingNameRE.MatchString(name) {
+				return fmt.Errorf("invalid zone config field %q", name)
+			}
+			fields = append(fields, fmt.Sprintf("%s = %s", name, s.DefaultZone[name]))
+		}
+		if _, err := db.ExecContext(ctx, fmt.Sprintf(
+			"ALTER RANGE default CONFIGURE ZONE USING %s", strings.Join(fields, ", "),
+		)); err != nil {
+			return fmt.Errorf("configuring default zone: %v", err)
+		}
+		config, err := defaultZoneConfig(ctx, db)
+		if err != nil {
+			return err
+		}
+		log.Printf("default zone config: %s", config)
+	}
+
+	for _, path := range s.BootstrapSQL {
+		script, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		log.Printf("running bootstrap SQL %q", path)
+		if _, err := db.ExecContext(ctx, string(script)); err != nil {
+			return fmt.Errorf("running %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// defaultZoneConfig returns the SQL of the default zone config. Its column
+// changed name across versions, so it is the last one.
+func defaultZoneConfig(ctx context.Context, db *sql.DB) (string, error) {
+	rows, err := db.QueryContext(ctx, "SHOW ZONE CONFIGURATION FOR RANGE default")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+		return "", sql.ErrNoRows
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return "", err
+	}
+	return values[len(values)-1].String, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,43 @@
+package cluster
+
+import (
+	"context"
+	"io"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// Logs writes the output of the cockroach process of the node to w. With
+// follow, it keeps writing new output until ctx is done or the node
+// stops.
+func (d *DockerCluster) Logs(ctx context.Context, id NodeID, follow bool, w io.Writer) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	logs, err := d.c.ContainerLogs(ctx, node.container(), types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     follow,
+	})
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+	_, err = stdcopy.StdCopy(w, w, logs)
+	return err
+}
+
+// SQLShellCommand returns the docker command line that opens an
+// interactive SQL shell on the node, as root, inside its container.
+func (d *DockerCluster) SQLShellCommand(id NodeID) ([]string, error) {
+	node, err := d.node(id)
+	if err != nil {
+		return nil, err
+	}
+	return []string{
+		"docker", "exec", "-it", node.container(),
+		"/cockroach/cockroach", "sql", d.securityFlag(), "--host=localhost:26257",
+	}, nil
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strconv"
 
 	toxiproxy "github.com/Shopify/toxiproxy/client"
 	"github.com/docker/docker/api/types"
@@ -13,7 +12,6 @@ import (
 	"github.com/docker/go-connections/nat"
 	"github.com/lego/roachnest/pkg/host"
 	"github.com/moby/moby/client"
-	"github.com/phayes/freeport"
 )
 
 type DockerToxiproxy struct {
@@ -22,12 +20,31 @@ type DockerToxiproxy struct {
 	apiPort         int
 	toxiproxyClient *toxiproxy.Client
 
+	// ports maps each published container port to its host port. The
+	// host ports are assigned by Docker, and read back on Start.
+	ports map[int]int
+
 	config DockerToxiproxyConfig
 }
 
 type DockerToxiproxyConfig struct {
 	Name        string
 	NetworkName string
+
+	// Ports are container ports, besides the API port, to publish on the
+	// host so that proxies listening on them can be reached from the
+	// outside.
+	Ports []int
+
+	// Labels are set on the container.
+	Labels map[string]string
+}
+
+// toxiproxyAPIPort is the container port of the toxiproxy API.
+const toxiproxyAPIPort nat.Port = "8474/tcp"
+
+func tcpPort(port int) nat.Port {
+	return nat.Port(fmt.Sprintf("%d/tcp", port))
 }
 
 func PreloadToxiproxyImage(ctx context.Context, c *client.Client) error {
@@ -45,31 +62,30 @@ func NewDockerToxiproxy(ctx context.Context, c *client.Client, config DockerToxi
 	d := &DockerToxiproxy{
 		c:      c,
 		config: config,
+		ports:  make(map[int]int, len(config.Ports)),
 	}
 
-	bindings := make(nat.PortMap)
-	// Bind a port to access toxiproxy from the outside.
-	// FIXME(joey): Use a random, free port. Even better, reserve or
-	// pre-acquire the port so there is no race condition to acquire it.
-	// This is probably a hard problem though (transferring port to
-	// another process, with Go).
-
-	openPort, err := freeport.GetFreePort()
-	if err != nil {
-		return nil, err
+	// Publish the API port, and any extra ports, on host ports that
+	// Docker picks when the container starts.
+	bindings := nat.PortMap{toxiproxyAPIPort: []nat.PortBinding{{}}}
+	exposed := nat.PortSet{toxiproxyAPIPort: struct{}{}}
+	for _, port := range config.Ports {
+		containerPort := tcpPort(port)
+		exposed[containerPort] = struct{}{}
+		bindings[containerPort] = []nat.PortBinding{{}}
 	}
-	bindings["8474/tcp"] = []nat.PortBinding{nat.PortBinding{HostPort: strconv.Itoa(openPort)}}
-	d.apiPort = openPort
 
 	endpoints := make(map[string]*network.EndpointSettings, 1)
 	endpoints[d.config.NetworkName] = &network.EndpointSettings{}
 
-	log.Printf("creating toxiproxy container %q bound to localhost:%d", d.config.Name, openPort)
+	log.Printf("creating toxiproxy container %q", d.config.Name)
 	resp, err := d.c.ContainerCreate(
 		ctx,
 		&container.Config{
-			Image:    "shopify/toxiproxy:latest",
-			Hostname: d.config.Name,
+			Image:        "shopify/toxiproxy:latest",
+			Hostname:     d.config.Name,
+			ExposedPorts: exposed,
+			Labels:       d.config.Labels,
 		},
 		&container.HostConfig{
 			// FIXME(joey): Might not want to set this. Not sure about the
@@ -98,6 +114,42 @@ func (d *DockerToxiproxy) Start(ctx context.Context) error {
 	if err := d.c.ContainerStart(ctx, d.containerID, types.ContainerStartOptions{}); err != nil {
 		return err
 	}
+	if err := d.readPorts(ctx); err != nil {
+		return err
+	}
+	log.Printf("toxiproxy container %q available at localhost:%d", d.config.Name, d.apiPort)
+	return nil
+}
+
+// AttachDockerToxiproxy returns the toxiproxy of an existing, started
+// container, created with the config.
+func AttachDockerToxiproxy(ctx context.Context, c *client.Client, config DockerToxiproxyConfig, containerID string) (*DockerToxiproxy, error) {
+	d := &DockerToxiproxy{
+		c:           c,
+		containerID: containerID,
+		config:      config,
+		ports:       make(map[int]int, len(config.Ports)),
+	}
+	if err := d.readPorts(ctx); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readPorts reads back the host ports that Docker published the API port
+// and Ports on.
+func (d *DockerToxiproxy) readPorts(ctx context.Context) error {
+	var err error
+	if d.apiPort, err = host.DockerHostPort(ctx, d.c, d.containerID, toxiproxyAPIPort); err != nil {
+		return err
+	}
+	for _, port := range d.config.Ports {
+		hostPort, err := host.DockerHostPort(ctx, d.c, d.containerID, tcpPort(port))
+		if err != nil {
+			return err
+		}
+		d.ports[port] = hostPort
+	}
 	return nil
 }
 
@@ -116,15 +168,35 @@ func (d *DockerToxiproxy) Cleanup(ctx context.Context) error {
 	return nil
 }
 
-// If the listen address is empty, a random port will be assigned and
-// returned.
+// IPAddress returns the address of the toxiproxy container on its
+// network. The container must be started.
+func (d *DockerToxiproxy) IPAddress(ctx context.Context) (string, error) {
+	info, err := d.c.ContainerInspect(ctx, d.containerID)
+	if err != nil {
+		return "", err
+	}
+	endpoint, ok := info.NetworkSettings.Networks[d.config.NetworkName]
+	if !ok || endpoint.IPAddress == "" {
+		return "", fmt.Errorf("toxiproxy container %q has no address on network %q", d.config.Name, d.config.NetworkName)
+	}
+	return endpoint.IPAddress, nil
+}
+
+// HostPort returns the host port that a container port in Ports is
+// published on. The container must be started.
+func (d *DockerToxiproxy) HostPort(port int) (int, error) {
+	hostPort, ok := d.ports[port]
+	if !ok {
+		return 0, fmt.Errorf("port %d of toxiproxy container %q is not published", port, d.config.Name)
+	}
+	return hostPort, nil
+}
+
+// If the listen address is empty, toxiproxy listens on a port picked
+// inside the container, and the returned proxy holds the address.
 func (d *DockerToxiproxy) AddProxy(name string, listen string, upstream string) (*toxiproxy.Proxy, error) {
 	if listen == "" {
-		openPort, err := freeport.GetFreePort()
-		if err != nil {
-			return nil, err
-		}
-		listen = fmt.Sprintf("%s:%d", d.config.Name, openPort)
+		listen = "0.0.0.0:0"
 	}
 
 	proxy, err := d.GetClient().CreateProxy(name, listen, upstream)
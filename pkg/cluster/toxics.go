@@ -0,0 +1,209 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	toxiproxy "github.com/Shopify/toxiproxy/client"
+)
+
+// Target is the part of the network a toxic is added to. It is either a
+// Link, or a NodeID for every link between the node and other nodes.
+// Client as a target is every link from the clients to a gateway.
+type Target interface {
+	links(size int) []Link
+}
+
+func (id NodeID) links(size int) []Link {
+	links := make([]Link, 0, 2*size)
+	for other := 0; other < size; other++ {
+		links = append(links, Link{From: id, To: NodeID(other)})
+		if NodeID(other) != id && id != Client {
+			links = append(links, Link{From: NodeID(other), To: id})
+		}
+	}
+	return links
+}
+
+func (l Link) links(size int) []Link {
+	return []Link{l}
+}
+
+// Toxic is a fault added to the network by one of the Add methods of
+// the cluster. It stays until it is removed, or until ResetAllToxics.
+type Toxic struct {
+	d    *DockerCluster
+	name string
+	// parts are the links and streams the toxic is on, which Remove
+	// takes it off of.
+	parts []toxicPart
+}
+
+// toxicPart is a toxic on one stream of a link.
+type toxicPart struct {
+	link   Link
+	stream string
+}
+
+func (t *Toxic) String() string {
+	return t.name
+}
+
+// Remove takes the toxic off every link it was added to. Removing a
+// toxic more than once is a no-op, so Remove can be deferred. If Remove
+// fails, calling it again removes what is left.
+func (t *Toxic) Remove() error {
+	d := t.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.toxics[t.name]; !ok {
+		return nil
+	}
+
+	log.Printf("removing toxic %q", t.name)
+	if err := t.removeParts(); err != nil {
+		return err
+	}
+	delete(d.toxics, t.name)
+	return nil
+}
+
+// removeParts removes the toxic from its links, and keeps the parts it
+// could not remove.
+func (t *Toxic) removeParts() error {
+	for len(t.parts) > 0 {
+		p := t.parts[0]
+		if err := t.d.links[p.link].RemoveToxic(toxicName(t.name, p.stream)); err != nil {
+			return fmt.Errorf("removing toxic %q from %s: %v", t.name, p.link, err)
+		}
+		t.parts = t.parts[1:]
+	}
+	return nil
+}
+
+// AddLatency delays data sent over the target, so every round trip over
+// it takes latency longer, give or take jitter.
+func (d *DockerCluster) AddLatency(ctx context.Context, target Target, latency, jitter time.Duration) (*Toxic, error) {
+	return d.addToxic(target, "latency", []string{"upstream"}, toxiproxy.Attributes{
+		"latency": millis(latency),
+		"jitter":  millis(jitter),
+	})
+}
+
+// LimitBandwidth caps the rate of data sent over the target, in each
+// direction, to kbps kilobytes per second.
+func (d *DockerCluster) LimitBandwidth(ctx context.Context, target Target, kbps int) (*Toxic, error) {
+	return d.addToxic(target, "bandwidth", []string{"upstream", "downstream"}, toxiproxy.Attributes{
+		"rate": kbps,
+	})
+}
+
+// Timeout stops all data sent over the target, and closes connections
+// after timeout. A timeout of 0 keeps connections open forever.
+func (d *DockerCluster) Timeout(ctx context.Context, target Target, timeout time.Duration) (*Toxic, error) {
+	return d.addToxic(target, "timeout", []string{"upstream"}, toxiproxy.Attributes{
+		"timeout": millis(timeout),
+	})
+}
+
+// SlowClose delays closing connections over the target by delay.
+func (d *DockerCluster) SlowClose(ctx context.Context, target Target, delay time.Duration) (*Toxic, error) {
+	return d.addToxic(target, "slow_close", []string{"downstream"}, toxiproxy.Attributes{
+		"delay": millis(delay),
+	})
+}
+
+// Slicer splits data sent over the target into packets of averageSize
+// bytes, give or take sizeVariation, with delay between each packet.
+func (d *DockerCluster) Slicer(ctx context.Context, target Target, averageSize, sizeVariation int, delay time.Duration) (*Toxic, error) {
+	return d.addToxic(target, "slicer", []string{"upstream", "downstream"}, toxiproxy.Attributes{
+		"average_size":   averageSize,
+		"size_variation": sizeVariation,
+		"delay":          int64(delay / time.Microsecond),
+	})
+}
+
+// ResetPeer resets connections over the target with a TCP RST after
+// timeout. A timeout of 0 resets them as soon as data is sent.
+func (d *DockerCluster) ResetPeer(ctx context.Context, target Target, timeout time.Duration) (*Toxic, error) {
+	return d.addToxic(target, "reset_peer", []string{"upstream"}, toxiproxy.Attributes{
+		"timeout": millis(timeout),
+	})
+}
+
+// ResetAllToxics removes every toxic from the network, including the
+// ones added by Partition and PartitionOneWay. The latencies between
+// regions are added back.
+func (d *DockerCluster) ResetAllToxics(ctx context.Context) error {
+	if !d.settings.SetupToxiproxy && !d.settings.ProxyClients {
+		return errNoToxiproxy
+	}
+	if err := d.resetToxics(); err != nil {
+		return err
+	}
+	return d.addRegionLatencies(ctx)
+}
+
+func (d *DockerCluster) resetToxics() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	log.Printf("resetting all toxics")
+	for _, toxi := range d.sidecars() {
+		if err := toxi.GetClient().ResetState(); err != nil {
+			return err
+		}
+	}
+	d.toxics = make(map[string]*Toxic)
+	d.cut = make(map[Link]bool)
+	return nil
+}
+
+func (d *DockerCluster) addToxic(target Target, typeName string, streams []string, attrs toxiproxy.Attributes) (*Toxic, error) {
+	if !d.settings.SetupToxiproxy && !d.settings.ProxyClients {
+		return nil, errNoToxiproxy
+	}
+	links := target.links(len(d.nodes))
+	for _, l := range links {
+		if _, ok := d.links[l]; !ok {
+			return nil, fmt.Errorf("no link %s in a cluster of %d nodes", l, len(d.nodes))
+		}
+	}
+
+	d.mu.Lock()
+	d.toxicSeq++
+	t := &Toxic{
+		d:    d,
+		name: fmt.Sprintf("%s-%d", typeName, d.toxicSeq),
+	}
+	d.toxics[t.name] = t
+	d.mu.Unlock()
+
+	log.Printf("adding toxic %q to %v with %v", t.name, target, attrs)
+	for _, l := range links {
+		for _, stream := range streams {
+			if _, err := d.links[l].AddToxic(toxicName(t.name, stream), typeName, stream, 1, attrs); err != nil {
+				// Do not leave the toxic on some of the links. Only the
+				// parts added so far are removed.
+				if removeErr := t.Remove(); removeErr != nil {
+					log.Printf("failed to remove partially added toxic %q: %v", t.name, removeErr)
+				}
+				return nil, err
+			}
+			d.mu.Lock()
+			t.parts = append(t.parts, toxicPart{link: l, stream: stream})
+			d.mu.Unlock()
+		}
+	}
+	return t, nil
+}
+
+func toxicName(name, stream string) string {
+	return fmt.Sprintf("%s-%s", name, stream)
+}
+
+func millis(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
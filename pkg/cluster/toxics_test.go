@@ -0,0 +1,164 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	toxiproxy "github.com/Shopify/toxiproxy/client"
+)
+
+// fakeToxiproxy serves the parts of the API of toxiproxy that toxics
+// use, for the proxies of links.
+type fakeToxiproxy struct {
+	mu      sync.Mutex
+	proxies map[string]map[string]toxiproxy.Toxic
+	// failAdd is a proxy that toxics cannot be added to.
+	failAdd string
+}
+
+func (f *fakeToxiproxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "proxies":
+		proxies := make(map[string]*toxiproxy.Proxy)
+		for name, toxics := range f.proxies {
+			proxy := &toxiproxy.Proxy{Name: name, Enabled: true, ActiveToxics: toxiproxy.Toxics{}}
+			for _, t := range toxics {
+				proxy.ActiveToxics = append(proxy.ActiveToxics, t)
+			}
+			proxies[name] = proxy
+		}
+		json.NewEncoder(w).Encode(proxies)
+	case r.Method == "POST" && len(parts) == 3 && parts[2] == "toxics":
+		if parts[1] == f.failAdd {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		var t toxiproxy.Toxic
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.proxies[parts[1]][t.Name] = t
+		json.NewEncoder(w).Encode(t)
+	case r.Method == "DELETE" && len(parts) == 4:
+		if _, ok := f.proxies[parts[1]][parts[3]]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(toxiproxy.ApiError{Message: "toxic not found", Status: http.StatusNotFound})
+			return
+		}
+		delete(f.proxies[parts[1]], parts[3])
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeToxiproxy) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, toxics := range f.proxies {
+		n += len(toxics)
+	}
+	return n
+}
+
+// newFakeToxicCluster returns a cluster of size nodes whose links are
+// proxies of a fake toxiproxy.
+func newFakeToxicCluster(t *testing.T, f *fakeToxiproxy, url string, size int) *DockerCluster {
+	d := &DockerCluster{
+		settings: Settings{Size: size, SetupToxiproxy: true},
+		nodes:    make([]*dockerNode, size),
+		links:    make(map[Link]*toxiproxy.Proxy),
+		cut:      make(map[Link]bool),
+		toxics:   make(map[string]*Toxic),
+	}
+	f.mu.Lock()
+	for from := NodeID(0); from < NodeID(size); from++ {
+		for to := NodeID(0); to < NodeID(size); to++ {
+			if _, ok := f.proxies[Link{From: from, To: to}.proxyName()]; !ok {
+				f.proxies[Link{From: from, To: to}.proxyName()] = make(map[string]toxiproxy.Toxic)
+			}
+		}
+	}
+	f.mu.Unlock()
+	proxies, err := toxiproxy.NewClient(url).Proxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for from := NodeID(0); from < NodeID(size); from++ {
+		for to := NodeID(0); to < NodeID(size); to++ {
+			l := Link{From: from, To: to}
+			d.links[l] = proxies[l.proxyName()]
+		}
+	}
+	return d
+}
+
+func TestRemoveToxic(t *testing.T) {
+	f := &fakeToxiproxy{proxies: make(map[string]map[string]toxiproxy.Toxic)}
+	server := httptest.NewServer(f)
+	defer server.Close()
+	d := newFakeToxicCluster(t, f, server.URL, 3)
+
+	// Latency is on the upstream of every link of the node only.
+	latency, err := d.AddLatency(context.Background(), NodeID(2), 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bandwidth, err := d.LimitBandwidth(context.Background(), Link{From: 0, To: 1}, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(); n != 5+2 {
+		t.Fatalf("expected 7 toxics, got %d", n)
+	}
+	if err := latency.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(); n != 2 {
+		t.Fatalf("expected the latency to be gone from every link, %d toxics are left", n)
+	}
+	if err := latency.Remove(); err != nil {
+		t.Fatalf("removing a toxic twice: %v", err)
+	}
+
+	// A cluster attached to the same proxies rebuilds the streams of the
+	// toxic, and removes it.
+	attached := newFakeToxicCluster(t, f, server.URL, 3)
+	for l, proxy := range attached.links {
+		for _, toxic := range proxy.ActiveToxics {
+			attached.attachToxic(l, toxic.Name, toxic.Stream)
+		}
+	}
+	if err := attached.toxics[bandwidth.name].Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(); n != 0 {
+		t.Fatalf("expected the bandwidth limit to be gone, %d toxics are left", n)
+	}
+
+	// A toxic that fails to be added to a link is taken off the links it
+	// was added to.
+	f.mu.Lock()
+	f.failAdd = Link{From: 2, To: 1}.proxyName()
+	f.mu.Unlock()
+	if _, err := d.AddLatency(context.Background(), NodeID(1), 50*time.Millisecond, 0); err == nil {
+		t.Fatal("expected adding the latency to fail")
+	}
+	if n := f.count(); n != 0 {
+		t.Fatalf("expected the partially added latency to be removed, %d toxics are left", n)
+	}
+	if _, ok := d.toxics["latency-3"]; ok {
+		t.Fatal("expected the partially added latency to be forgotten")
+	}
+}
@@ -0,0 +1,160 @@
+package cluster
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/docker/docker/api/types"
+
+	"github.com/lego/roachnest/pkg/host"
+)
+
+const preserveDowngradeSetting = "cluster.preserve_downgrade_option"
+
+// UpgradeNode replaces the container of a node with one running the image
+// and tag, keeping the store of the node. It drains and stops the node,
+// starts the new container and waits for the node to rejoin. An empty
+// image keeps the current one. Going back to an older tag rolls the node
+// back, as long as the upgrade was not finalized.
+//
+// The store must be in a volume, so nodes with a Store in their spec
+// cannot be upgraded.
+func (d *DockerCluster) UpgradeNode(ctx context.Context, id NodeID, image, tag string) error {
+	node, err := d.node(id)
+	if err != nil {
+		return err
+	}
+	spec := node.currentSpec()
+	if spec.Store != "" {
+		return errors.New("cannot upgrade a node with a Store, which does not outlive its container")
+	}
+
+	if image != "" {
+		spec.Image = image
+	}
+	spec.Tag = tag
+	if err := host.DockerPreloadImage(d.c, host.DockerConfig{
+		Image: spec.Image,
+		Tag:   spec.Tag,
+	}); err != nil {
+		return err
+	}
+
+	info, err := d.c.ContainerInspect(ctx, node.container())
+	if err != nil {
+		return err
+	}
+	if info.State.Paused {
+		if err := d.UnpauseNode(ctx, id); err != nil {
+			return err
+		}
+	}
+	if info.State.Running {
+		if err := d.drain(ctx, node); err != nil {
+			return err
+		}
+		if err := d.stop(ctx, node); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("replacing node %q with %s", node.name, spec.imageWithTag())
+	if err := d.c.ContainerRemove(ctx, node.container(), types.ContainerRemoveOptions{}); err != nil {
+		return err
+	}
+	// The node keeps its old spec until the new container starts. If it
+	// cannot be replaced, it is left without a running container.
+	if err := d.createContainer(ctx, node, spec); err != nil {
+		d.setStatus(node, host.Deleted)
+		return err
+	}
+	log.Printf("starting container %q", node.container())
+	if err := d.c.ContainerStart(ctx, node.container(), types.ContainerStartOptions{}); err != nil {
+		d.setStatus(node, host.Stopped)
+		return err
+	}
+	d.mu.Lock()
+	node.spec = spec
+	d.mu.Unlock()
+	d.setStatus(node, host.Starting)
+	if err := d.readPorts(ctx, node); err != nil {
+		return err
+	}
+	if err := d.waitReady(ctx, []*dockerNode{node}, false); err != nil {
+		return err
+	}
+	d.setStatus(node, host.Running)
+	return nil
+}
+
+// PreserveDowngrade keeps the cluster from finalizing an upgrade from
+// version, e.g. "19.1", so that its nodes can still be rolled back.
+func (d *DockerCluster) PreserveDowngrade(ctx context.Context, version string) error {
+	db, err := d.liveConnection(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("preserving downgrade to %s", version)
+	_, err = db.ExecContext(ctx, "SET CLUSTER SETTING "+preserveDowngradeSetting+" = $1", version)
+	return err
+}
+
+// FinalizeUpgrade lets the cluster finalize the upgrade, once every node
+// runs the new version. Nodes cannot be rolled back after it.
+func (d *DockerCluster) FinalizeUpgrade(ctx context.Context) error {
+	db, err := d.liveConnection(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("finalizing upgrade")
+	_, err = db.ExecContext(ctx, "RESET CLUSTER SETTING "+preserveDowngradeSetting)
+	return err
+}
+
+// ClusterVersion returns the active version of the cluster.
+func (d *DockerCluster) ClusterVersion(ctx context.Context) (string, error) {
+	db, err := d.liveConnection(ctx)
+	if err != nil {
+		return "", err
+	}
+	var version string
+	err = db.QueryRowContext(ctx, "SHOW CLUSTER SETTING version").Scan(&version)
+	return version, err
+}
+
+// BuildInfo returns crdb_internal.node_build_info of the node, e.g. its
+// Tag.
+func (d *DockerCluster) BuildInfo(ctx context.Context, id NodeID) (map[string]string, error) {
+	db, err := d.GetConnectionTo(ctx, id, "")
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx, "SELECT field, value FROM crdb_internal.node_build_info")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	info := make(map[string]string)
+	for rows.Next() {
+		var field, value string
+		if err := rows.Scan(&field, &value); err != nil {
+			return nil, err
+		}
+		info[field] = value
+	}
+	return info, rows.Err()
+}
+
+// liveConnection returns a connection through the first running node, as
+// some nodes may be down during an upgrade.
+func (d *DockerCluster) liveConnection(ctx context.Context) (*sql.DB, error) {
+	for _, node := range d.nodes {
+		if d.getStatus(node) == host.Running {
+			return d.GetConnectionTo(ctx, node.id, "")
+		}
+	}
+	return nil, errors.New("no node is running")
+}
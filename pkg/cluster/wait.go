@@ -0,0 +1,282 @@
+package cluster
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+
+	"github.com/lego/roachnest/pkg/host"
+)
+
+// defaultWaitTimeout bounds WaitUntil when the context has no deadline.
+const defaultWaitTimeout = 2 * time.Minute
+
+// NodesNotReadyError is returned when some nodes did not reach a status
+// before the wait gave up. Nodes maps each such node name to the last
+// reason it was not ready.
+type NodesNotReadyError struct {
+	Status host.Status
+	Nodes  map[string]error
+}
+
+func (e *NodesNotReadyError) Error() string {
+	names := make([]string, 0, len(e.Nodes))
+	for name := range e.Nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	reasons := make([]string, 0, len(names))
+	for _, name := range names {
+		reasons = append(reasons, fmt.Sprintf("%s (%v)", name, e.Nodes[name]))
+	}
+	return fmt.Sprintf("nodes did not become %s: %s", e.Status, strings.Join(reasons, ", "))
+}
+
+// WaitUntil blocks until every node has reached the status. Only
+// host.Running and host.Stopped can be waited on.
+//
+// A cluster is Running once every node passes /health?ready=1, every
+// node shows up in crdb_internal.gossip_liveness and no node reports
+// under-replicated ranges.
+func (d *DockerCluster) WaitUntil(ctx context.Context, status host.Status) error {
+	log.Printf("waiting for cluster to become %s", status)
+	switch status {
+	case host.Running:
+		return d.waitReady(ctx, d.nodes, true)
+	case host.Stopped:
+		return poll(ctx, d.checkStopped)
+	}
+	return fmt.Errorf("waiting for status %s is not supported", status)
+}
+
+// waitReady waits for the nodes to be healthy and live. If replicated is
+// set, it also waits for the nodes to have no under-replicated ranges.
+func (d *DockerCluster) waitReady(ctx context.Context, nodes []*dockerNode, replicated bool) error {
+	return poll(ctx, func(ctx context.Context) error {
+		return d.checkReady(ctx, nodes, replicated)
+	})
+}
+
+// poll retries check with a backoff until it succeeds or the context is
+// done, and returns the last error of check.
+func poll(ctx context.Context, check func(context.Context) error) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultWaitTimeout)
+		defer cancel()
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxInterval = 2 * time.Second
+	b.MaxElapsedTime = 0
+	return backoff.Retry(func() error {
+		return check(ctx)
+	}, backoff.WithContext(b, ctx))
+}
+
+func (d *DockerCluster) checkReady(ctx context.Context, nodes []*dockerNode, replicated bool) error {
+	notReady := make(map[string]error)
+	nodeIDs := make(map[string]int, len(nodes))
+	// Liveness is queried through the first healthy node, as other nodes
+	// of the cluster may be down.
+	var gateway *dockerNode
+	for _, node := range nodes {
+		if err := d.checkHealth(ctx, node); err != nil {
+			notReady[node.name] = d.notHealthyReason(ctx, node, err)
+			continue
+		}
+		id, err := d.localNodeID(ctx, node)
+		if err != nil {
+			notReady[node.name] = err
+			continue
+		}
+		nodeIDs[node.name] = id
+		if gateway == nil {
+			gateway = node
+		}
+	}
+
+	if gateway != nil {
+		live, err := d.gossipLiveness(ctx, gateway)
+		for name, id := range nodeIDs {
+			if err != nil {
+				notReady[name] = fmt.Errorf("querying liveness: %v", err)
+			} else if !live[id] {
+				notReady[name] = fmt.Errorf("n%d missing from gossip liveness", id)
+			}
+		}
+	}
+
+	// Replication is only meaningful once every node is part of the
+	// cluster.
+	if replicated && len(notReady) == 0 {
+		for _, node := range nodes {
+			count, err := d.underReplicatedRanges(ctx, node)
+			if err != nil {
+				notReady[node.name] = err
+			} else if count > 0 {
+				notReady[node.name] = fmt.Errorf("%d under-replicated ranges", count)
+			}
+		}
+	}
+
+	if len(notReady) > 0 {
+		err := &NodesNotReadyError{Status: host.Running, Nodes: notReady}
+		for _, reason := range notReady {
+			if _, ok := reason.(*OOMKilledError); ok {
+				// An OOM killed node will not come back on its own.
+				return backoff.Permanent(err)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// notHealthyReason returns why a node failed its health check. A node
+// that was OOM killed is reported as such, rather than with err.
+func (d *DockerCluster) notHealthyReason(ctx context.Context, node *dockerNode, err error) error {
+	info, inspectErr := d.c.ContainerInspect(ctx, node.container())
+	if inspectErr == nil && !info.State.Running && info.State.OOMKilled {
+		return &OOMKilledError{ExitCode: info.State.ExitCode}
+	}
+	return err
+}
+
+func (d *DockerCluster) checkStopped(ctx context.Context) error {
+	notReady := make(map[string]error)
+	for _, node := range d.nodes {
+		info, err := d.c.ContainerInspect(ctx, node.container())
+		if err != nil {
+			notReady[node.name] = err
+		} else if info.State.Running {
+			notReady[node.name] = fmt.Errorf("container is %s", info.State.Status)
+		}
+	}
+	if len(notReady) > 0 {
+		return &NodesNotReadyError{Status: host.Stopped, Nodes: notReady}
+	}
+	return nil
+}
+
+// adminTimeout bounds each request to the admin HTTP API of a node.
+const adminTimeout = 5 * time.Second
+
+func (d *DockerCluster) adminGet(ctx context.Context, node *dockerNode, path string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", node.AdminURL()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.adminClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (d *DockerCluster) checkHealth(ctx context.Context, node *dockerNode) error {
+	resp, err := d.adminGet(ctx, node, "/health?ready=1")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// localNodeID returns the CockroachDB node ID of the node. It is read
+// over SQL rather than from the admin API, which needs a login in secure
+// mode.
+func (d *DockerCluster) localNodeID(ctx context.Context, node *dockerNode) (int, error) {
+	conn, err := d.directConn(node)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var id int
+	if err := conn.QueryRowContext(ctx,
+		"SELECT node_id FROM crdb_internal.node_build_info LIMIT 1",
+	).Scan(&id); err != nil {
+		return 0, err
+	}
+	if id == 0 {
+		return 0, errors.New("node has no ID yet")
+	}
+	return id, nil
+}
+
+// directConn opens a connection straight to the node. Waiting bypasses
+// the client proxies, so that it is not slowed down by toxics added to
+// them.
+func (d *DockerCluster) directConn(node *dockerNode) (*sql.DB, error) {
+	port, _ := node.ports()
+	connStr, err := d.connString(port, "")
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("postgres", connStr)
+}
+
+func (d *DockerCluster) gossipLiveness(ctx context.Context, gateway *dockerNode) (map[int]bool, error) {
+	conn, err := d.directConn(gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "SELECT node_id FROM crdb_internal.gossip_liveness")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	live := make(map[int]bool)
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		live[id] = true
+	}
+	return live, rows.Err()
+}
+
+// underReplicatedRanges sums the ranges_underreplicated metric over the
+// stores of the node.
+func (d *DockerCluster) underReplicatedRanges(ctx context.Context, node *dockerNode) (int, error) {
+	resp, err := d.adminGet(ctx, node, "/_status/vars")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var total float64
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexAny(line, "{ "); i < 0 || line[:i] != "ranges_underreplicated" {
+			continue
+		}
+		fields := strings.Fields(line)
+		value, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			return 0, err
+		}
+		total += value
+	}
+	return int(total), scanner.Err()
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/host"
+	"github.com/moby/moby/client"
+)
+
+// upConfig is the config file of up, in JSON.
+type upConfig struct {
+	Settings cluster.Settings
+	Docker   cluster.DockerConfig
+}
+
+func up(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("up", flag.ExitOnError)
+	configFile := flags.String("config", "", "JSON file with the Settings and Docker config of the cluster; flags override it")
+	size := flags.Int("size", 3, "number of nodes")
+	image := flags.String("image", "cockroachdb/cockroach", "image of the nodes")
+	tag := flags.String("tag", "latest", "tag of the image")
+	name := flags.String("name", "roach", "prefix of the cluster name")
+	toxiproxy := flags.Bool("toxiproxy", false, "set up toxiproxy between nodes, for partition and latency")
+	proxyClients := flags.Bool("proxy-clients", false, "route SQL clients through toxiproxy")
+	secure := flags.Bool("secure", false, "start the nodes with certificates")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config := upConfig{
+		Settings: cluster.Settings{Size: *size},
+		Docker:   cluster.DockerConfig{Image: *image, Tag: *tag},
+	}
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("%s: %v", *configFile, err)
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "size":
+			config.Settings.Size = *size
+		case "image":
+			config.Docker.Image = *image
+		case "tag":
+			config.Docker.Tag = *tag
+		case "name":
+			config.Docker.NamePrefix = *name
+		case "toxiproxy":
+			config.Settings.SetupToxiproxy = *toxiproxy
+		case "proxy-clients":
+			config.Settings.ProxyClients = *proxyClients
+		case "secure":
+			config.Settings.Secure = *secure
+		}
+	})
+	if config.Docker.NamePrefix == "" {
+		config.Docker.NamePrefix = *name
+	}
+	if config.Docker.NetworkName == "" {
+		config.Docker.NetworkName = config.Docker.NamePrefix + "net"
+	}
+	if config.Docker.Image == "" {
+		config.Docker.Image = *image
+	}
+	if config.Docker.Tag == "" {
+		config.Docker.Tag = *tag
+	}
+	// The cluster outlives this process.
+	config.Docker.Detached = true
+
+	c, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	d, err := cluster.NewDockerCluster(ctx, c, config.Settings, config.Docker)
+	if err != nil {
+		return err
+	}
+	if err := d.Start(ctx); err != nil {
+		cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		if err := d.Cleanup(cleanupCtx); err != nil {
+			fmt.Fprintf(os.Stderr, "error on cleanup: %+v\n", err)
+		}
+		return err
+	}
+	fmt.Printf("cluster %s is up\n\n", d.Name())
+	return printStatus(ctx, d)
+}
+
+func down(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("down", flag.ExitOnError)
+	name := clusterFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	d, err := attach(ctx, *name)
+	if err != nil {
+		return err
+	}
+	if err := d.Cleanup(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("cluster %s is down\n", d.Name())
+	return nil
+}
+
+func ls(ctx context.Context, args []string) error {
+	c, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	names, err := cluster.List(ctx, c)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+func status(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	name := clusterFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	d, err := attach(ctx, *name)
+	if err != nil {
+		return err
+	}
+	return printStatus(ctx, d)
+}
+
+func printStatus(ctx context.Context, d *cluster.DockerCluster) error {
+	nodes, err := d.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tNAME\tSTATUS\tLOCALITY\tSQL\tADMIN")
+	for _, info := range nodes {
+		sqlAddr, adminURL := "-", "-"
+		if info.Status == host.Running || info.Status == host.Paused {
+			node := d.Node(info.ID)
+			sqlAddr, adminURL = node.SQLAddr(), node.AdminURL()
+		}
+		status := info.Status.String()
+		if info.OOMKilled {
+			status += " (OOM killed)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", info.ID, info.Name, status, info.Locality, sqlAddr, adminURL)
+	}
+	return w.Flush()
+}
+
+func logs(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	name := clusterFlag(flags)
+	follow := flags.Bool("f", false, "follow the logs")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("logs takes one node")
+	}
+	id, err := parseNodeID(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	d, err := attach(ctx, *name)
+	if err != nil {
+		return err
+	}
+	return d.Logs(ctx, id, *follow, os.Stdout)
+}
+
+func sqlShell(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("sql", flag.ExitOnError)
+	name := clusterFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var id cluster.NodeID
+	if flags.NArg() > 1 {
+		return errors.New("sql takes at most one node")
+	}
+	if flags.NArg() == 1 {
+		var err error
+		if id, err = parseNodeID(flags.Arg(0)); err != nil {
+			return err
+		}
+	}
+	d, err := attach(ctx, *name)
+	if err != nil {
+		return err
+	}
+	argv, err := d.SQLShellCommand(id)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
+
+func kill(ctx context.Context, args []string) error {
+	return nodeCommand(ctx, "kill", args, func(d *cluster.DockerCluster, id cluster.NodeID) error {
+		return d.KillNode(ctx, id)
+	})
+}
+
+func restart(ctx context.Context, args []string) error {
+	return nodeCommand(ctx, "restart", args, func(d *cluster.DockerCluster, id cluster.NodeID) error {
+		return d.RestartNode(ctx, id)
+	})
+}
+
+// nodeCommand runs fn on the node given as the only argument.
+func nodeCommand(ctx context.Context, name string, args []string, fn func(*cluster.DockerCluster, cluster.NodeID) error) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	clusterName := clusterFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("%s takes one node", name)
+	}
+	id, err := parseNodeID(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	d, err := attach(ctx, *clusterName)
+	if err != nil {
+		return err
+	}
+	return fn(d, id)
+}
+
+func partition(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("partition", flag.ExitOnError)
+	name := clusterFlag(flags)
+	oneWay := flags.Bool("one-way", false, "stop the first node from reaching the second, but not the other way")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		return errors.New("partition takes at least two groups of nodes")
+	}
+	groups := make([][]cluster.NodeID, 0, flags.NArg())
+	for _, arg := range flags.Args() {
+		var group []cluster.NodeID
+		for _, s := range strings.Split(arg, ",") {
+			id, err := parseNodeID(s)
+			if err != nil {
+				return err
+			}
+			group = append(group, id)
+		}
+		groups = append(groups, group)
+	}
+	d, err := attach(ctx, *name)
+	if err != nil {
+		return err
+	}
+	if *oneWay {
+		if len(groups) != 2 || len(groups[0]) != 1 || len(groups[1]) != 1 {
+			return errors.New("partition -one-way takes two nodes")
+		}
+		return d.PartitionOneWay(ctx, groups[0][0], groups[1][0])
+	}
+	return d.Partition(ctx, groups...)
+}
+
+func heal(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("heal", flag.ExitOnError)
+	name := clusterFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	d, err := attach(ctx, *name)
+	if err != nil {
+		return err
+	}
+	return d.Heal(ctx)
+}
+
+func latency(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("latency", flag.ExitOnError)
+	name := clusterFlag(flags)
+	jitter := flags.Duration("jitter", 0, "jitter of the latency")
+	reset := flags.Bool("reset", false, "remove every toxic, including latencies and partitions, instead")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *reset {
+		if flags.NArg() != 0 {
+			return errors.New("latency -reset takes no arguments")
+		}
+		d, err := attach(ctx, *name)
+		if err != nil {
+			return err
+		}
+		return d.ResetAllToxics(ctx)
+	}
+
+	if flags.NArg() != 2 {
+		return errors.New("latency takes a target and a latency")
+	}
+	target, err := parseTarget(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	delay, err := time.ParseDuration(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	d, err := attach(ctx, *name)
+	if err != nil {
+		return err
+	}
+	toxic, err := d.AddLatency(ctx, target, delay, *jitter)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("added %s\n", toxic)
+	return nil
+}
+
+func reap(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("reap", flag.ExitOnError)
+	olderThan := flags.Duration("older-than", time.Hour, "only reap clusters created longer ago than this")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := client.NewEnvClient()
+	if err != nil {
+		return err
+	}
+	return cluster.Reap(ctx, c, *olderThan)
+}
+
+func clusterFlag(flags *flag.FlagSet) *string {
+	return flags.String("cluster", "", "name of the cluster, see ls")
+}
+
+// attach attaches to the cluster with the name, or to the only cluster
+// if the name is empty.
+func attach(ctx context.Context, name string) (*cluster.DockerCluster, error) {
+	c, err := client.NewEnvClient()
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		names, err := cluster.List(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		switch len(names) {
+		case 0:
+			return nil, errors.New("there is no cluster")
+		case 1:
+			name = names[0]
+		default:
+			return nil, fmt.Errorf("there are %d clusters, pick one with -cluster: %s",
+				len(names), strings.Join(names, ", "))
+		}
+	}
+	return cluster.Attach(ctx, c, name)
+}
+
+// parseNodeID parses a node as 1 or n1, or client.
+func parseNodeID(s string) (cluster.NodeID, error) {
+	if s == cluster.Client.String() {
+		return cluster.Client, nil
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(s, "n"))
+	if err != nil || id < 0 {
+		return 0, fmt.Errorf("invalid node %q", s)
+	}
+	return cluster.NodeID(id), nil
+}
+
+// parseTarget parses a node, or a link as 0->1.
+func parseTarget(s string) (cluster.Target, error) {
+	parts := strings.Split(s, "->")
+	if len(parts) == 1 {
+		return parseNodeID(s)
+	}
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid link %q", s)
+	}
+	from, err := parseNodeID(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseNodeID(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return cluster.Link{From: from, To: to}, nil
+}
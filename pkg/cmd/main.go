@@ -2,70 +2,71 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
-
-	"github.com/lego/roachnest/pkg/cluster"
-	"github.com/moby/moby/client"
 )
 
-func main() {
-	ctx := context.Background()
-	sigs := make(chan os.Signal, 1)
-	done := make(chan bool, 1)
+// command is a subcommand of roachnest. It gets the arguments after its
+// name.
+type command struct {
+	usage string
+	run   func(ctx context.Context, args []string) error
+}
+
+var commands = map[string]command{
+	"up":        {"up [flags]: create and start a cluster", up},
+	"down":      {"down [-cluster name]: remove a cluster", down},
+	"ls":        {"ls: list the clusters", ls},
+	"status":    {"status [-cluster name]: show the state and ports of every node", status},
+	"logs":      {"logs [-cluster name] [-f] <node>: print the logs of a node", logs},
+	"sql":       {"sql [-cluster name] [node]: open a SQL shell on a node, n0 by default", sqlShell},
+	"kill":      {"kill [-cluster name] <node>: kill a node", kill},
+	"restart":   {"restart [-cluster name] <node>: restart a node", restart},
+	"partition": {"partition [-cluster name] [-one-way] <nodes> <nodes>...: partition groups of nodes, e.g. 0,1 2", partition},
+	"heal":      {"heal [-cluster name]: heal every partition", heal},
+	"latency":   {"latency [-cluster name] [-jitter d] [-reset] <target> <latency>: add latency to a node, link (0->1) or client", latency},
+	"reap":      {"reap [-older-than d]: remove clusters left behind by processes that are gone", reap},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: roachnest <command> [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "\nClusters are found by name. With -cluster unset, the only cluster is used.\n")
+}
 
-	signal.Notify(sigs, syscall.SIGINT)
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
 
-	childCtx, cancelFn := context.WithCancel(ctx)
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigs
 		log.Printf("interrupted. beginning shutdown")
-		cancelFn()
-		done <- true
+		cancel()
 	}()
 
-	_, err := createCluster(childCtx)
-	if err != nil {
-		log.Printf("error creating cluster: %+v", err)
-		// log.Printf("attempting to cleanup resources")
-		// if err := cluster.Cleanup(ctx); err != nil {
-		// 	log.Printf("error on cleanup: %+v", err)
-		// }
-		// log.Printf("resources cleaned up successfully")
+	if err := cmd.run(ctx, os.Args[2:]); err != nil {
+		log.Printf("error: %+v", err)
 		os.Exit(1)
 	}
-
-	<-done
-
-	// log.Printf("attempting to cleanup resources")
-	// if err := cluster.Cleanup(ctx); err != nil {
-	// 	log.Printf("error on cleanup: %+v", err)
-	// 	os.Exit(1)
-	// }
-	// log.Printf("resources cleaned up successfully")
-	os.Exit(0)
-}
-
-func createCluster(ctx context.Context) (cluster.Cluster, error) {
-	client, err := client.NewEnvClient()
-	cluster, err := cluster.NewDockerCluster(
-		ctx, client, cluster.Settings{
-			Size:           3,
-			SetupToxiproxy: true,
-		}, cluster.DockerConfig{
-			NetworkName: "roachnet",
-			NamePrefix:  "roach",
-			Image:       "cockroachdb/cockroach",
-			Tag:         "latest",
-		},
-	)
-	if err != nil {
-		return cluster, err
-	}
-	if err := cluster.Start(ctx); err != nil {
-		return cluster, err
-	}
-	return cluster, nil
 }
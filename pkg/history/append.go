@@ -0,0 +1,123 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Append runs transactions of appends to, and reads of, lists at a few
+// keys. Every value appended to a key is unique, so reads reveal the
+// order of the writes, and CheckListAppend can find the dependencies
+// between transactions.
+type Append struct {
+	// Keys is the number of keys. It defaults to 5.
+	Keys int
+	// MaxOps is the largest number of operations in a transaction. It
+	// defaults to 4.
+	MaxOps int
+
+	// next is the next value to append to each key. Generate is called
+	// by one client at a time.
+	next map[int]int
+}
+
+// Mop is an operation of a transaction: an append of Value to the list
+// at Key, or a read of the List at Key.
+type Mop struct {
+	F     string
+	Key   int
+	Value int
+	List  []int
+}
+
+func (m Mop) String() string {
+	if m.F == "append" {
+		return fmt.Sprintf("append %d %d", m.Key, m.Value)
+	}
+	return fmt.Sprintf("r %d %v", m.Key, m.List)
+}
+
+func (a *Append) Setup(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx,
+		"CREATE TABLE IF NOT EXISTS lists (k INT PRIMARY KEY, v STRING NOT NULL)",
+	)
+	return err
+}
+
+func (a *Append) Generate(rng *rand.Rand) Op {
+	keys, maxOps := a.Keys, a.MaxOps
+	if keys == 0 {
+		keys = 5
+	}
+	if maxOps == 0 {
+		maxOps = 4
+	}
+	if a.next == nil {
+		a.next = make(map[int]int)
+	}
+	mops := make([]Mop, 1+rng.Intn(maxOps))
+	for i := range mops {
+		key := rng.Intn(keys)
+		if rng.Intn(2) == 0 {
+			mops[i] = Mop{F: "r", Key: key}
+			continue
+		}
+		a.next[key]++
+		mops[i] = Mop{F: "append", Key: key, Value: a.next[key]}
+	}
+	return Op{F: "txn", Value: mops}
+}
+
+func (a *Append) Invoke(ctx context.Context, db *sql.DB, op Op) Op {
+	mops := append([]Mop(nil), op.Value.([]Mop)...)
+	err := inTxn(ctx, db, func(tx *sql.Tx) error {
+		for i, m := range mops {
+			if m.F == "append" {
+				if _, err := tx.ExecContext(ctx,
+					`INSERT INTO lists (k, v) VALUES ($1, $2)
+					 ON CONFLICT (k) DO UPDATE SET v = lists.v || ',' || $2`,
+					m.Key, strconv.Itoa(m.Value),
+				); err != nil {
+					return err
+				}
+				continue
+			}
+			var v string
+			err := tx.QueryRowContext(ctx, "SELECT v FROM lists WHERE k = $1", m.Key).Scan(&v)
+			if err != nil && err != sql.ErrNoRows {
+				return err
+			}
+			list, err := parseList(v)
+			if err != nil {
+				return err
+			}
+			mops[i].List = list
+		}
+		return nil
+	})
+	return complete(ctx, op, mops, err)
+}
+
+func parseList(v string) ([]int, error) {
+	if v == "" {
+		return []int{}, nil
+	}
+	parts := strings.Split(v, ",")
+	list := make([]int, 0, len(parts))
+	for _, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+func (a *Append) Check(h History) error {
+	return CheckListAppend(h)
+}
@@ -0,0 +1,156 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// Bank transfers money between accounts, and reads every balance. Every
+// read must see the total it started with, and no negative balance.
+type Bank struct {
+	Accounts int
+	Total    int64
+}
+
+// Transfer is the value of a transfer operation.
+type Transfer struct {
+	From, To int
+	Amount   int64
+}
+
+func (b Bank) Setup(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx,
+		"CREATE TABLE IF NOT EXISTS bank (id INT PRIMARY KEY, balance INT NOT NULL)",
+	); err != nil {
+		return err
+	}
+	for i := 0; i < b.Accounts; i++ {
+		balance := b.Total / int64(b.Accounts)
+		if i == 0 {
+			balance += b.Total % int64(b.Accounts)
+		}
+		if _, err := db.ExecContext(ctx,
+			"UPSERT INTO bank (id, balance) VALUES ($1, $2)", i, balance,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b Bank) Generate(rng *rand.Rand) Op {
+	if rng.Intn(2) == 0 {
+		return Op{F: "read"}
+	}
+	from := rng.Intn(b.Accounts)
+	to := (from + 1 + rng.Intn(b.Accounts-1)) % b.Accounts
+	return Op{F: "transfer", Value: Transfer{
+		From:   from,
+		To:     to,
+		Amount: 1 + rng.Int63n(5),
+	}}
+}
+
+func (b Bank) Invoke(ctx context.Context, db *sql.DB, op Op) Op {
+	switch op.F {
+	case "read":
+		balances, err := b.read(ctx, db)
+		return complete(ctx, op, balances, err)
+	case "transfer":
+		t := op.Value.(Transfer)
+		return complete(ctx, op, t, inTxn(ctx, db, func(tx *sql.Tx) error {
+			var balance int64
+			if err := tx.QueryRowContext(ctx,
+				"SELECT balance FROM bank WHERE id = $1", t.From,
+			).Scan(&balance); err != nil {
+				return err
+			}
+			if balance < t.Amount {
+				return errNotApplied
+			}
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE bank SET balance = balance - $1 WHERE id = $2", t.Amount, t.From,
+			); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				"UPDATE bank SET balance = balance + $1 WHERE id = $2", t.Amount, t.To,
+			)
+			return err
+		}))
+	}
+	panic(fmt.Sprintf("unknown bank operation %q", op.F))
+}
+
+func (b Bank) read(ctx context.Context, db *sql.DB) (map[int]int64, error) {
+	rows, err := db.QueryContext(ctx, "SELECT id, balance FROM bank")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	balances := make(map[int]int64, b.Accounts)
+	for rows.Next() {
+		var id int
+		var balance int64
+		if err := rows.Scan(&id, &balance); err != nil {
+			return nil, err
+		}
+		balances[id] = balance
+	}
+	return balances, rows.Err()
+}
+
+func (b Bank) Check(h History) error {
+	return CheckBank(h, b.Accounts, b.Total)
+}
+
+// CheckBank checks that every read of a bank history saw all accounts,
+// none of them negative, adding up to total.
+func CheckBank(h History, accounts int, total int64) error {
+	var problems []string
+	for _, p := range h.pairs() {
+		if p.invoke.F != "read" || p.complete.Type != OK {
+			continue
+		}
+		balances := p.complete.Value.(map[int]int64)
+		var sum int64
+		ids := make([]int, 0, len(balances))
+		for id, balance := range balances {
+			sum += balance
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		switch {
+		case len(balances) != accounts:
+			problems = append(problems, fmt.Sprintf("read %d saw %d accounts: %v", p.complete.Index, len(balances), ids))
+		case sum != total:
+			problems = append(problems, fmt.Sprintf("read %d saw a total of %d: %v", p.complete.Index, sum, balances))
+		}
+		for _, id := range ids {
+			if balances[id] < 0 {
+				problems = append(problems, fmt.Sprintf("read %d saw account %d at %d", p.complete.Index, id, balances[id]))
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("bank history is invalid:\n%s", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// inTxn runs fn in a transaction, and commits it if fn succeeds.
+func inTxn(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,77 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/nemesis"
+	"github.com/lego/roachnest/pkg/testutils"
+)
+
+func TestHistoryUnderPartitions(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size:           3,
+		SetupToxiproxy: true,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	root, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.ExecContext(ctx, "CREATE DATABASE jepsen"); err != nil {
+		t.Fatal(err)
+	}
+	// One client connection per gateway, so that partitioned gateways
+	// see their operations fail or time out.
+	var dbs []*sql.DB
+	for id := cluster.NodeID(0); id < 3; id++ {
+		db, err := c.GetConnectionTo(ctx, id, "jepsen")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		workload Workload
+	}{
+		{"bank", Bank{Accounts: 5, Total: 100}},
+		{"register", Register{}},
+		{"append", &Append{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.workload.Setup(ctx, dbs[0]); err != nil {
+				t.Fatal(err)
+			}
+			n := nemesis.New(c, nemesis.Config{
+				Faults:        []nemesis.Fault{nemesis.Partition{}},
+				Interval:      2 * time.Second,
+				FaultDuration: 5 * time.Second,
+				Logf:          t.Logf,
+			})
+			n.Start(ctx)
+			runCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			h, err := Run(runCtx, tc.workload, RunConfig{
+				DBs:  dbs,
+				Seed: n.Seed(),
+			})
+			cancel()
+			if _, err := n.Stop(); err != nil {
+				t.Fatal(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := tc.workload.Check(h); err != nil {
+				t.Fatalf("%v (seed %d)", err, n.Seed())
+			}
+			t.Logf("checked %d ops", len(h))
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package history
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Anomaly is a consistency anomaly found in a history, named as by Adya:
+// G0 write cycle, G1a aborted read, G1b intermediate read, G1c circular
+// information flow, G-single read skew and G2 anti-dependency cycle.
+type Anomaly struct {
+	Type string
+	// Ops are the indexes of the completions of the transactions.
+	Ops    []int
+	Detail string
+}
+
+func (a Anomaly) String() string {
+	return fmt.Sprintf("%s: %s", a.Type, a.Detail)
+}
+
+// Anomalies is the error of a history with anomalies.
+type Anomalies []Anomaly
+
+func (as Anomalies) Error() string {
+	lines := make([]string, 0, len(as))
+	for _, a := range as {
+		lines = append(lines, a.String())
+	}
+	return fmt.Sprintf("found %d anomalies:\n%s", len(as), strings.Join(lines, "\n"))
+}
+
+// Kinds of dependencies between transactions: T1 -ww-> T2 when T2 writes
+// the version after the one T1 writes, T1 -wr-> T2 when T2 reads what T1
+// writes, and T1 -rw-> T2 when T2 writes the version after the one T1
+// reads.
+type dep uint8
+
+const (
+	ww dep = 1 << iota
+	wr
+	rw
+)
+
+func (d dep) String() string {
+	switch d.weakest() {
+	case ww:
+		return "ww"
+	case wr:
+		return "wr"
+	}
+	return "rw"
+}
+
+// txn is a transaction of a list-append history.
+type txn struct {
+	typ  Type
+	op   int
+	mops []Mop
+}
+
+type keyValue struct {
+	key, value int
+}
+
+// CheckListAppend checks that a list-append history is serializable, as
+// Elle does: the longest read of each key gives the order of its
+// versions, from which the dependencies between transactions are
+// inferred. A cycle of dependencies is an anomaly.
+func CheckListAppend(h History) error {
+	var txns []txn
+	for _, p := range h.pairs() {
+		if p.invoke.F != "txn" {
+			continue
+		}
+		t := txn{typ: p.complete.Type, op: p.complete.Index, mops: p.invoke.Value.([]Mop)}
+		if t.typ == OK {
+			t.mops = p.complete.Value.([]Mop)
+		}
+		if t.op < 0 {
+			t.op = p.invoke.Index
+		}
+		txns = append(txns, t)
+	}
+
+	// writer is the transaction that appended each value, and last the
+	// last value each transaction appended to each key.
+	writer := make(map[keyValue]int)
+	last := make(map[keyValue]int)
+	for i, t := range txns {
+		for _, m := range t.mops {
+			if m.F == "append" {
+				writer[keyValue{m.Key, m.Value}] = i
+				last[keyValue{m.Key, i}] = m.Value
+			}
+		}
+	}
+
+	var anomalies Anomalies
+	longest := make(map[int][]int)
+	for i, t := range txns {
+		if t.typ != OK {
+			continue
+		}
+		for _, m := range t.mops {
+			if m.F != "r" {
+				continue
+			}
+			order := longest[m.Key]
+			if !isPrefix(order, m.List) && !isPrefix(m.List, order) {
+				anomalies = append(anomalies, Anomaly{
+					Type:   "incompatible-order",
+					Ops:    []int{t.op},
+					Detail: fmt.Sprintf("read of key %d by op %d is %v, which is not compatible with %v", m.Key, t.op, m.List, order),
+				})
+				continue
+			}
+			if len(m.List) > len(order) {
+				longest[m.Key] = m.List
+			}
+			if len(m.List) == 0 {
+				continue
+			}
+			v := m.List[len(m.List)-1]
+			w, ok := writer[keyValue{m.Key, v}]
+			switch {
+			case !ok:
+				anomalies = append(anomalies, Anomaly{
+					Type:   "garbage-read",
+					Ops:    []int{t.op},
+					Detail: fmt.Sprintf("op %d read %d at key %d, which was never appended", t.op, v, m.Key),
+				})
+			case w == i:
+			case txns[w].typ == Fail:
+				anomalies = append(anomalies, Anomaly{
+					Type:   "G1a",
+					Ops:    []int{txns[w].op, t.op},
+					Detail: fmt.Sprintf("op %d read %d at key %d, appended by op %d which failed", t.op, v, m.Key, txns[w].op),
+				})
+			case last[keyValue{m.Key, w}] != v:
+				anomalies = append(anomalies, Anomaly{
+					Type:   "G1b",
+					Ops:    []int{txns[w].op, t.op},
+					Detail: fmt.Sprintf("op %d read %d at key %d, an intermediate append of op %d", t.op, v, m.Key, txns[w].op),
+				})
+			}
+		}
+	}
+
+	deps := make(map[[2]int]dep)
+	addDep := func(from, to int, d dep) {
+		if from != to && txns[from].typ != Fail && txns[to].typ != Fail {
+			deps[[2]int{from, to}] |= d
+		}
+	}
+	for key, order := range longest {
+		for i := 1; i < len(order); i++ {
+			prev, ok1 := writer[keyValue{key, order[i-1]}]
+			next, ok2 := writer[keyValue{key, order[i]}]
+			if ok1 && ok2 {
+				addDep(prev, next, ww)
+			}
+		}
+	}
+	for i, t := range txns {
+		if t.typ != OK {
+			continue
+		}
+		for _, m := range t.mops {
+			if m.F != "r" {
+				continue
+			}
+			if len(m.List) > 0 {
+				if w, ok := writer[keyValue{m.Key, m.List[len(m.List)-1]}]; ok {
+					addDep(w, i, wr)
+				}
+			}
+			order := longest[m.Key]
+			if len(m.List) < len(order) && isPrefix(order, m.List) {
+				if w, ok := writer[keyValue{m.Key, order[len(m.List)]}]; ok {
+					addDep(i, w, rw)
+				}
+			}
+		}
+	}
+
+	anomalies = append(anomalies, cycles(txns, deps)...)
+	if len(anomalies) > 0 {
+		return anomalies
+	}
+	return nil
+}
+
+// isPrefix reports whether prefix is a prefix of list.
+func isPrefix(list, prefix []int) bool {
+	if len(prefix) > len(list) {
+		return false
+	}
+	for i := range prefix {
+		if list[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// cycles returns an anomaly for every strongly connected component of
+// the dependency graph, with a cycle through it. Cycles of ww edges are
+// looked for first, then of ww and wr edges, then of any edges, so that
+// each component is reported as its weakest anomaly.
+func cycles(txns []txn, deps map[[2]int]dep) []Anomaly {
+	out := make(map[int][]int)
+	for e := range deps {
+		out[e[0]] = append(out[e[0]], e[1])
+	}
+	for _, next := range out {
+		sort.Ints(next)
+	}
+
+	var anomalies []Anomaly
+	for _, scc := range components(len(txns), out) {
+		if len(scc) < 2 {
+			continue
+		}
+		in := make(map[int]bool, len(scc))
+		for _, v := range scc {
+			in[v] = true
+		}
+		for _, allowed := range []dep{ww, ww | wr, ww | wr | rw} {
+			cycle := findCycle(scc, in, out, deps, allowed)
+			if cycle == nil {
+				continue
+			}
+			anomalies = append(anomalies, describeCycle(txns, deps, cycle, allowed))
+			break
+		}
+	}
+	return anomalies
+}
+
+// components returns the strongly connected components of the graph,
+// with Tarjan's algorithm.
+func components(n int, out map[int][]int) [][]int {
+	index := make([]int, n)
+	low := make([]int, n)
+	onStack := make([]bool, n)
+	for i := range index {
+		index[i] = -1
+	}
+	var stack []int
+	var sccs [][]int
+	next := 0
+	var visit func(v int)
+	visit = func(v int) {
+		index[v], low[v] = next, next
+		next++
+		stack = append(stack, v)
+		onStack[v] = true
+		for _, w := range out[v] {
+			if index[w] < 0 {
+				visit(w)
+				if low[w] < low[v] {
+					low[v] = low[w]
+				}
+			} else if onStack[w] && index[w] < low[v] {
+				low[v] = index[w]
+			}
+		}
+		if low[v] == index[v] {
+			var scc []int
+			for {
+				w := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[w] = false
+				scc = append(scc, w)
+				if w == v {
+					break
+				}
+			}
+			sort.Ints(scc)
+			sccs = append(sccs, scc)
+		}
+	}
+	for v := 0; v < n; v++ {
+		if index[v] < 0 {
+			visit(v)
+		}
+	}
+	return sccs
+}
+
+// findCycle returns a cycle in the component over edges with an allowed
+// dependency, as the path from a node back to itself, or nil. The cycle
+// is the shortest through the first node that is on one.
+func findCycle(scc []int, in map[int]bool, out map[int][]int, deps map[[2]int]dep, allowed dep) []int {
+	var best []int
+	for _, start := range scc {
+		parent := map[int]int{start: -1}
+		queue := []int{start}
+		for len(queue) > 0 && best == nil {
+			v := queue[0]
+			queue = queue[1:]
+			for _, w := range out[v] {
+				if !in[w] || deps[[2]int{v, w}]&allowed == 0 {
+					continue
+				}
+				if w == start {
+					cycle := []int{start}
+					for u := v; u != start; u = parent[u] {
+						cycle = append(cycle, u)
+					}
+					cycle = append(cycle, start)
+					// The path was built backwards.
+					for i, j := 0, len(cycle)-1; i < j; i, j = i+1, j-1 {
+						cycle[i], cycle[j] = cycle[j], cycle[i]
+					}
+					best = cycle
+					break
+				}
+				if _, ok := parent[w]; !ok {
+					parent[w] = v
+					queue = append(queue, w)
+				}
+			}
+		}
+		if best != nil {
+			return best
+		}
+	}
+	return nil
+}
+
+func describeCycle(txns []txn, deps map[[2]int]dep, cycle []int, allowed dep) Anomaly {
+	var b strings.Builder
+	ops := make([]int, 0, len(cycle)-1)
+	rws := 0
+	var seen dep
+	for i := 0; i+1 < len(cycle); i++ {
+		d := deps[[2]int{cycle[i], cycle[i+1]}] & allowed
+		seen |= d.weakest()
+		if d.weakest() == rw {
+			rws++
+		}
+		ops = append(ops, txns[cycle[i]].op)
+		fmt.Fprintf(&b, "op %d -%s-> ", txns[cycle[i]].op, d.weakest())
+	}
+	fmt.Fprintf(&b, "op %d", txns[cycle[len(cycle)-1]].op)
+
+	typ := "G2"
+	switch {
+	case seen == ww:
+		typ = "G0"
+	case seen&rw == 0:
+		typ = "G1c"
+	case rws == 1:
+		typ = "G-single"
+	}
+	return Anomaly{Type: typ, Ops: ops, Detail: b.String()}
+}
+
+// weakest returns the first of ww, wr and rw in the dependencies, which
+// makes for the weakest anomaly.
+func (d dep) weakest() dep {
+	switch {
+	case d&ww != 0:
+		return ww
+	case d&wr != 0:
+		return wr
+	}
+	return rw
+}
@@ -0,0 +1,119 @@
+package history
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Type is the type of an operation in a history. Every operation is
+// invoked, and then completes as OK if it took place, Fail if it did not,
+// or Info if it is unknown whether it did, e.g. after a timeout.
+type Type int
+
+const (
+	Invoke Type = iota
+	OK
+	Fail
+	Info
+)
+
+func (t Type) String() string {
+	switch t {
+	case Invoke:
+		return "invoke"
+	case OK:
+		return "ok"
+	case Fail:
+		return "fail"
+	case Info:
+		return "info"
+	}
+	return fmt.Sprintf("Type(%d)", int(t))
+}
+
+// Op is an invocation or a completion of an operation by a process. The
+// completion of an invocation is the next op of the same process.
+type Op struct {
+	// Index is the position of the op in the history.
+	Index   int
+	Process int
+	Type    Type
+	// F is the function of the operation, e.g. read or write, and Value
+	// its argument when invoked and its result when completed.
+	F     string
+	Value interface{}
+	// Error is why the operation failed, or is unknown.
+	Error string
+	Time  time.Time
+}
+
+func (op Op) String() string {
+	s := fmt.Sprintf("%d %d %s %s %v", op.Index, op.Process, op.Type, op.F, op.Value)
+	if op.Error != "" {
+		s += " " + op.Error
+	}
+	return s
+}
+
+// History is the ops of a run, in the order they happened.
+type History []Op
+
+// pair is an invocation with its completion. A process that crashed, or
+// a run that ended, may leave an invocation without completion, which is
+// then unknown like Info.
+type pair struct {
+	invoke   Op
+	complete Op
+}
+
+// pairs returns the operations of the history, in the order they were
+// invoked.
+func (h History) pairs() []pair {
+	var pairs []pair
+	pending := make(map[int]int)
+	for _, op := range h {
+		if op.Type == Invoke {
+			pending[op.Process] = len(pairs)
+			pairs = append(pairs, pair{invoke: op, complete: Op{
+				Index:   -1,
+				Process: op.Process,
+				Type:    Info,
+				F:       op.F,
+				Error:   "never completed",
+			}})
+			continue
+		}
+		i, ok := pending[op.Process]
+		if !ok {
+			continue
+		}
+		pairs[i].complete = op
+		delete(pending, op.Process)
+	}
+	return pairs
+}
+
+// Recorder records the ops of concurrent processes into a history.
+type Recorder struct {
+	mu  sync.Mutex
+	ops History
+}
+
+// Record appends the op to the history, with its index and time, and
+// returns it.
+func (r *Recorder) Record(op Op) Op {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	op.Index = len(r.ops)
+	op.Time = time.Now()
+	r.ops = append(r.ops, op)
+	return op
+}
+
+// History returns the ops recorded so far.
+func (r *Recorder) History() History {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append(History(nil), r.ops...)
+}
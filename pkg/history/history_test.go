@@ -0,0 +1,266 @@
+package history
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// build returns a history of the ops, with their indexes set.
+func build(ops ...Op) History {
+	h := make(History, len(ops))
+	for i, op := range ops {
+		op.Index = i
+		h[i] = op
+	}
+	return h
+}
+
+func TestComplete(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, tc := range []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want Type
+	}{
+		{"ok", context.Background(), nil, OK},
+		{"not applied", context.Background(), errNotApplied, Fail},
+		{"constraint violation", context.Background(), &pq.Error{Code: "23505"}, Fail},
+		{"connection failure", context.Background(), &pq.Error{Code: "08006"}, Info},
+		{"ambiguous commit", context.Background(), &pq.Error{Code: "40003"}, Info},
+		{"query canceled", context.Background(), &pq.Error{Code: "57014"}, Info},
+		{"connection closed", context.Background(), errors.New("driver: bad connection"), Info},
+		// Once the operation timed out, it may have applied whatever the
+		// error.
+		{"timed out", canceled, &pq.Error{Code: "23505"}, Info},
+	} {
+		if got := complete(tc.ctx, Op{Type: Invoke}, nil, tc.err).Type; got != tc.want {
+			t.Errorf("%s: completed as %v, expected %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCheckBank(t *testing.T) {
+	valid := build(
+		Op{Process: 0, Type: Invoke, F: "transfer", Value: Transfer{From: 0, To: 1, Amount: 5}},
+		Op{Process: 1, Type: Invoke, F: "read"},
+		Op{Process: 1, Type: OK, F: "read", Value: map[int]int64{0: 10, 1: 10}},
+		Op{Process: 0, Type: OK, F: "transfer", Value: Transfer{From: 0, To: 1, Amount: 5}},
+		Op{Process: 1, Type: Invoke, F: "read"},
+		Op{Process: 1, Type: OK, F: "read", Value: map[int]int64{0: 5, 1: 15}},
+	)
+	if err := CheckBank(valid, 2, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := append(valid,
+		Op{Index: 6, Process: 1, Type: Invoke, F: "read"},
+		Op{Index: 7, Process: 1, Type: OK, F: "read", Value: map[int]int64{0: 5, 1: 10}},
+	)
+	if err := CheckBank(invalid, 2, 20); err == nil || !strings.Contains(err.Error(), "total of 15") {
+		t.Fatalf("expected a wrong total, got %v", err)
+	}
+}
+
+func TestCheckLinearizable(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		h     History
+		valid bool
+	}{
+		{
+			name: "sequential",
+			h: build(
+				Op{Process: 0, Type: Invoke, F: "write", Value: 1},
+				Op{Process: 0, Type: OK, F: "write", Value: 1},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 1},
+			),
+			valid: true,
+		},
+		{
+			name: "stale read",
+			h: build(
+				Op{Process: 0, Type: Invoke, F: "write", Value: 1},
+				Op{Process: 0, Type: OK, F: "write", Value: 1},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 0},
+			),
+		},
+		{
+			name: "concurrent read before write",
+			h: build(
+				Op{Process: 0, Type: Invoke, F: "write", Value: 1},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 0},
+				Op{Process: 0, Type: OK, F: "write", Value: 1},
+			),
+			valid: true,
+		},
+		{
+			name: "cas",
+			h: build(
+				Op{Process: 0, Type: Invoke, F: "cas", Value: CAS{Old: 0, New: 2}},
+				Op{Process: 0, Type: OK, F: "cas", Value: CAS{Old: 0, New: 2}},
+				Op{Process: 1, Type: Invoke, F: "cas", Value: CAS{Old: 0, New: 3}},
+				Op{Process: 1, Type: Fail, F: "cas", Value: CAS{Old: 0, New: 3}},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 2},
+			),
+			valid: true,
+		},
+		{
+			name: "info write takes effect late",
+			h: build(
+				Op{Process: 0, Type: Invoke, F: "write", Value: 1},
+				Op{Process: 0, Type: Info, F: "write", Value: 1},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 0},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 1},
+			),
+			valid: true,
+		},
+		{
+			name: "info write takes effect once",
+			h: build(
+				Op{Process: 0, Type: Invoke, F: "write", Value: 1},
+				Op{Process: 0, Type: Info, F: "write", Value: 1},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 1},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 0},
+			),
+		},
+		{
+			name: "failed write",
+			h: build(
+				Op{Process: 0, Type: Invoke, F: "write", Value: 1},
+				Op{Process: 0, Type: Fail, F: "write", Value: 1},
+				Op{Process: 1, Type: Invoke, F: "read"},
+				Op{Process: 1, Type: OK, F: "read", Value: 1},
+			),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := CheckLinearizable(tc.h, RegisterModel{})
+			if tc.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.valid && err == nil {
+				t.Fatal("expected the history not to be linearizable")
+			}
+		})
+	}
+}
+
+// txnOps returns the invocation and completion of a transaction.
+func txnOps(process int, typ Type, mops ...Mop) []Op {
+	return []Op{
+		{Process: process, Type: Invoke, F: "txn", Value: mops},
+		{Process: process, Type: typ, F: "txn", Value: mops},
+	}
+}
+
+func appendTo(key, value int) Mop { return Mop{F: "append", Key: key, Value: value} }
+
+func read(key int, list ...int) Mop { return Mop{F: "r", Key: key, List: append([]int{}, list...)} }
+
+func TestCheckListAppend(t *testing.T) {
+	const x, y = 0, 1
+	for _, tc := range []struct {
+		name    string
+		txns    [][]Op
+		anomaly string
+	}{
+		{
+			name: "serial",
+			txns: [][]Op{
+				txnOps(0, OK, appendTo(x, 1)),
+				txnOps(1, OK, read(x, 1), appendTo(x, 2)),
+				txnOps(2, OK, read(x, 1, 2)),
+			},
+		},
+		{
+			name: "aborted read",
+			txns: [][]Op{
+				txnOps(0, Fail, appendTo(x, 1)),
+				txnOps(1, OK, read(x, 1)),
+			},
+			anomaly: "G1a",
+		},
+		{
+			name: "intermediate read",
+			txns: [][]Op{
+				txnOps(0, OK, appendTo(x, 1), appendTo(x, 2)),
+				txnOps(1, OK, read(x, 1)),
+			},
+			anomaly: "G1b",
+		},
+		{
+			name: "incompatible orders",
+			txns: [][]Op{
+				txnOps(0, OK, appendTo(x, 1)),
+				txnOps(1, OK, appendTo(x, 2)),
+				txnOps(2, OK, read(x, 1, 2)),
+				txnOps(3, OK, read(x, 2, 1)),
+			},
+			anomaly: "incompatible-order",
+		},
+		{
+			name: "circular information flow",
+			txns: [][]Op{
+				txnOps(0, OK, appendTo(x, 1), read(y, 1)),
+				txnOps(1, OK, appendTo(y, 1), read(x, 1)),
+			},
+			anomaly: "G1c",
+		},
+		{
+			name: "read skew",
+			txns: [][]Op{
+				txnOps(0, OK, read(x), read(y, 1)),
+				txnOps(1, OK, appendTo(x, 1), appendTo(y, 1)),
+				txnOps(2, OK, read(x, 1)),
+			},
+			anomaly: "G-single",
+		},
+		{
+			name: "write skew",
+			txns: [][]Op{
+				txnOps(0, OK, read(x), appendTo(y, 1)),
+				txnOps(1, OK, read(y), appendTo(x, 1)),
+				txnOps(2, OK, read(x, 1), read(y, 1)),
+			},
+			anomaly: "G2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ops []Op
+			for _, txn := range tc.txns {
+				ops = append(ops, txn...)
+			}
+			err := CheckListAppend(build(ops...))
+			if tc.anomaly == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			anomalies, ok := err.(Anomalies)
+			if !ok {
+				t.Fatalf("expected %s, got %v", tc.anomaly, err)
+			}
+			for _, a := range anomalies {
+				if a.Type == tc.anomaly {
+					return
+				}
+			}
+			t.Fatalf("expected %s, got %v", tc.anomaly, err)
+		})
+	}
+}
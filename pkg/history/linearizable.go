@@ -0,0 +1,199 @@
+package history
+
+import (
+	"fmt"
+)
+
+// Model is the sequential specification of an object, for
+// CheckLinearizable. States must be comparable, as they are memoized.
+type Model interface {
+	Init() interface{}
+	// Step applies the operation to the state, and returns the next
+	// state. It returns false if the operation cannot complete as it did
+	// in that state, e.g. a read of another value.
+	Step(state interface{}, invoke, complete Op) (interface{}, bool)
+}
+
+// entry is a call or return event of an operation, in a doubly linked
+// list of the events of a history in order.
+type entry struct {
+	id         int
+	call       bool
+	pair       pair
+	match      *entry
+	prev, next *entry
+}
+
+// CheckLinearizable checks that the history of an object is linearizable
+// with respect to its model: that every operation appears to take effect
+// at once, between its invocation and its completion.
+//
+// It is the search of Wing and Gong with the memoization of Lowe, as in
+// Knossos. Failed operations did not happen and are left out. Operations
+// that are Info may have happened at any point after they were invoked,
+// or not at all. Info reads tell nothing and are left out.
+func CheckLinearizable(h History, m Model) error {
+	head := &entry{}
+	var calls, infoReturns []*entry
+	tail := head
+	appendEntry := func(e *entry) {
+		e.prev, tail.next = tail, e
+		tail = e
+	}
+
+	// Events are in history order, with the returns of Info operations at
+	// the end, as they may take effect any time later.
+	pairs := h.pairs()
+	returnAt := make(map[int]*entry)
+	mustLinearize := 0
+	for _, p := range pairs {
+		if p.complete.Type == Fail || (p.complete.Type != OK && p.invoke.F == "read") {
+			continue
+		}
+		call := &entry{id: len(calls), call: true, pair: p}
+		ret := &entry{id: call.id, pair: p, match: call}
+		call.match = ret
+		calls = append(calls, call)
+		if p.complete.Type == OK {
+			returnAt[p.complete.Index] = ret
+			mustLinearize++
+		} else {
+			infoReturns = append(infoReturns, ret)
+		}
+	}
+	callAt := make(map[int]*entry, len(calls))
+	for _, call := range calls {
+		callAt[call.pair.invoke.Index] = call
+	}
+	for _, op := range h {
+		if e, ok := callAt[op.Index]; ok && op.Type == Invoke {
+			appendEntry(e)
+		} else if e, ok := returnAt[op.Index]; ok && op.Type != Invoke {
+			appendEntry(e)
+		}
+	}
+	for _, e := range infoReturns {
+		appendEntry(e)
+	}
+
+	type frame struct {
+		call  *entry
+		state interface{}
+	}
+	var stack []frame
+	linearized := newBitset(len(calls))
+	cache := make(map[string][]interface{})
+	seen := func(b bitset, state interface{}) bool {
+		key := b.key()
+		for _, s := range cache[key] {
+			if s == state {
+				return true
+			}
+		}
+		cache[key] = append(cache[key], state)
+		return false
+	}
+
+	state := m.Init()
+	linearizedOK := 0
+	// deepest is the return that blocked the longest linearization, to
+	// report.
+	var deepest *entry
+	deepestLen := -1
+	e := head.next
+	for linearizedOK < mustLinearize {
+		if e.call {
+			next, ok := m.Step(state, e.pair.invoke, e.pair.complete)
+			if ok {
+				candidate := linearized.clone()
+				candidate.set(e.id)
+				if !seen(candidate, next) {
+					stack = append(stack, frame{call: e, state: state})
+					state, linearized = next, candidate
+					if e.pair.complete.Type == OK {
+						linearizedOK++
+					}
+					lift(e)
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+			continue
+		}
+
+		// A return was reached before its call could be linearized, so
+		// backtrack.
+		if len(stack) > deepestLen {
+			deepest, deepestLen = e, len(stack)
+		}
+		if len(stack) == 0 {
+			return fmt.Errorf("history is not linearizable: no state is valid for %s after linearizing %d operations",
+				deepest.pair.invoke, deepestLen)
+		}
+		top := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		state = top.state
+		linearized.clear(top.call.id)
+		if top.call.pair.complete.Type == OK {
+			linearizedOK--
+		}
+		unlift(top.call)
+		e = top.call.next
+	}
+	return nil
+}
+
+// lift takes the call and its return out of the list.
+func lift(call *entry) {
+	call.prev.next = call.next
+	if call.next != nil {
+		call.next.prev = call.prev
+	}
+	ret := call.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+// unlift puts back the call and its return, in the reverse order of lift.
+func unlift(call *entry) {
+	ret := call.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	call.prev.next = call
+	if call.next != nil {
+		call.next.prev = call
+	}
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int) {
+	b[i/64] |= 1 << uint(i%64)
+}
+
+func (b bitset) clear(i int) {
+	b[i/64] &^= 1 << uint(i%64)
+}
+
+func (b bitset) clone() bitset {
+	return append(bitset(nil), b...)
+}
+
+func (b bitset) key() string {
+	buf := make([]byte, 0, len(b)*8)
+	for _, w := range b {
+		for i := uint(0); i < 64; i += 8 {
+			buf = append(buf, byte(w>>i))
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,95 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+)
+
+// Register reads, writes and compare-and-sets a single register, which
+// must be linearizable. It starts at 0, and holds small values so that
+// compare-and-sets succeed now and then.
+type Register struct{}
+
+// CAS is the value of a compare-and-set operation, which sets the
+// register to New if it holds Old.
+type CAS struct {
+	Old, New int
+}
+
+const registerValues = 5
+
+func (Register) Setup(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx,
+		"CREATE TABLE IF NOT EXISTS register (id INT PRIMARY KEY, val INT NOT NULL)",
+	); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, "UPSERT INTO register (id, val) VALUES (0, 0)")
+	return err
+}
+
+func (Register) Generate(rng *rand.Rand) Op {
+	switch rng.Intn(3) {
+	case 0:
+		return Op{F: "read"}
+	case 1:
+		return Op{F: "write", Value: rng.Intn(registerValues)}
+	default:
+		return Op{F: "cas", Value: CAS{Old: rng.Intn(registerValues), New: rng.Intn(registerValues)}}
+	}
+}
+
+func (Register) Invoke(ctx context.Context, db *sql.DB, op Op) Op {
+	switch op.F {
+	case "read":
+		var val int
+		err := db.QueryRowContext(ctx, "SELECT val FROM register WHERE id = 0").Scan(&val)
+		return complete(ctx, op, val, err)
+	case "write":
+		_, err := db.ExecContext(ctx, "UPDATE register SET val = $1 WHERE id = 0", op.Value)
+		return complete(ctx, op, op.Value, err)
+	case "cas":
+		cas := op.Value.(CAS)
+		res, err := db.ExecContext(ctx,
+			"UPDATE register SET val = $1 WHERE id = 0 AND val = $2", cas.New, cas.Old,
+		)
+		if err == nil {
+			var n int64
+			if n, err = res.RowsAffected(); err == nil && n == 0 {
+				err = errNotApplied
+			}
+		}
+		return complete(ctx, op, cas, err)
+	}
+	panic(fmt.Sprintf("unknown register operation %q", op.F))
+}
+
+func (Register) Check(h History) error {
+	return CheckLinearizable(h, RegisterModel{})
+}
+
+// RegisterModel is a register of ints with read, write and cas
+// operations, starting at Initial.
+type RegisterModel struct {
+	Initial int
+}
+
+func (m RegisterModel) Init() interface{} {
+	return m.Initial
+}
+
+func (RegisterModel) Step(state interface{}, invoke, complete Op) (interface{}, bool) {
+	val := state.(int)
+	switch invoke.F {
+	case "read":
+		return val, complete.Value.(int) == val
+	case "write":
+		return invoke.Value.(int), true
+	case "cas":
+		cas := invoke.Value.(CAS)
+		return cas.New, cas.Old == val
+	}
+	return val, false
+}
@@ -0,0 +1,152 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Workload is run by concurrent clients, and checks the history they
+// record.
+type Workload interface {
+	// Setup creates the tables of the workload.
+	Setup(ctx context.Context, db *sql.DB) error
+	// Generate returns the next operation to invoke, with F and Value
+	// set, drawing any choice from rng.
+	Generate(rng *rand.Rand) Op
+	// Invoke performs the operation through db, and returns its
+	// completion.
+	Invoke(ctx context.Context, db *sql.DB, op Op) Op
+	// Check returns an error if the history is not valid.
+	Check(h History) error
+}
+
+// RunConfig configures Run.
+type RunConfig struct {
+	// DBs are the connections of the clients, e.g. one per gateway node.
+	// Client i uses DBs[i%len(DBs)].
+	DBs []*sql.DB
+	// Clients is the number of concurrent clients. It defaults to 5.
+	Clients int
+	// Ops is the number of operations to invoke, or zero to invoke them
+	// until ctx is done.
+	Ops int
+	// OpTimeout bounds every operation, which is Info once it passes. It
+	// defaults to 10s.
+	OpTimeout time.Duration
+	// Seed is the seed of the operations that are generated.
+	Seed int64
+}
+
+const (
+	defaultClients   = 5
+	defaultOpTimeout = 10 * time.Second
+)
+
+// Run runs the workload until ctx is done or Ops operations were invoked,
+// and returns the history. A client whose operation is Info goes on as a
+// new process, since its last operation may still take effect.
+func Run(ctx context.Context, w Workload, config RunConfig) (History, error) {
+	if len(config.DBs) == 0 {
+		return nil, errors.New("RunConfig has no DBs")
+	}
+	if config.Clients == 0 {
+		config.Clients = defaultClients
+	}
+	if config.OpTimeout == 0 {
+		config.OpTimeout = defaultOpTimeout
+	}
+
+	var r Recorder
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(config.Seed))
+	invoked := 0
+	// next returns the next operation, or false once done.
+	next := func() (Op, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ctx.Err() != nil || (config.Ops > 0 && invoked >= config.Ops) {
+			return Op{}, false
+		}
+		invoked++
+		return w.Generate(rng), true
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.Clients; i++ {
+		wg.Add(1)
+		go func(process int, db *sql.DB) {
+			defer wg.Done()
+			for {
+				op, ok := next()
+				if !ok {
+					return
+				}
+				op.Process, op.Type = process, Invoke
+				op = r.Record(op)
+
+				opCtx, cancel := context.WithTimeout(ctx, config.OpTimeout)
+				complete := w.Invoke(opCtx, db, op)
+				cancel()
+				complete.Process = process
+				r.Record(complete)
+				if complete.Type == Info {
+					process += config.Clients
+				}
+			}
+		}(i, config.DBs[i%len(config.DBs)])
+	}
+	wg.Wait()
+	return r.History(), nil
+}
+
+// complete returns the completion of op with the value and error of
+// performing it with ctx. Errors that the statement surely did not take
+// effect after fail the operation, others make it Info, as do all errors
+// once ctx is done, since the statement may have applied before it was
+// canceled.
+func complete(ctx context.Context, op Op, value interface{}, err error) Op {
+	op.Value = value
+	switch {
+	case err == nil:
+		op.Type = OK
+	case ctx.Err() == nil && definite(err):
+		op.Type = Fail
+		op.Error = err.Error()
+	default:
+		op.Type = Info
+		op.Error = err.Error()
+	}
+	return op
+}
+
+// definite reports whether the error guarantees that the transaction did
+// not commit.
+func definite(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	if !ok {
+		return err == errNotApplied
+	}
+	switch {
+	case pqErr.Code.Class() == "08":
+		// Connection exceptions.
+		return false
+	case pqErr.Code == "40003":
+		// statement_completion_unknown, the result is ambiguous.
+		return false
+	case pqErr.Code == "57014":
+		// query_canceled, e.g. by the timeout of the operation, which
+		// may have applied already.
+		return false
+	}
+	return true
+}
+
+// errNotApplied is returned by workloads for operations that they chose
+// not to apply, e.g. a transfer from an account without enough money.
+var errNotApplied = errors.New("not applied")
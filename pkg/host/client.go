@@ -2,6 +2,7 @@ package host
 
 import (
 	"database/sql"
+	"fmt"
 )
 
 type Status int
@@ -14,8 +15,29 @@ const (
 	Stopping
 	Stopped
 	Deleted
+	Paused
 )
 
+func (s Status) String() string {
+	switch s {
+	case Created:
+		return "created"
+	case Starting:
+		return "starting"
+	case Running:
+		return "running"
+	case Stopping:
+		return "stopping"
+	case Stopped:
+		return "stopped"
+	case Deleted:
+		return "deleted"
+	case Paused:
+		return "paused"
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
 type Client interface {
 	// FIXME(joey): Will this be needed? Maybe for other clients.
 	// Setup() error
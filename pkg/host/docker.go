@@ -1,13 +1,19 @@
 package host
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
 	"github.com/moby/moby/client"
 )
 
@@ -40,6 +46,104 @@ func DockerPreloadImage(c *client.Client, settings DockerConfig) error {
 	return err
 }
 
+// DockerExec runs cmd inside a running container and returns its
+// combined output. A non-zero exit code is returned as an error that
+// includes the output.
+func DockerExec(ctx context.Context, c *client.Client, containerID string, cmd []string) (string, error) {
+	exec, err := c.ContainerExecCreate(ctx, containerID, types.ExecConfig{
+		AttachStdout: true,
+		AttachStderr: true,
+		Cmd:          cmd,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.ContainerExecAttach(ctx, exec.ID, types.ExecConfig{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Close()
+
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, resp.Reader); err != nil {
+		return output.String(), err
+	}
+
+	inspect, err := c.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return output.String(), err
+	}
+	if inspect.ExitCode != 0 {
+		return output.String(), fmt.Errorf("%q exited with code %d: %s",
+			strings.Join(cmd, " "), inspect.ExitCode, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
+
+// DockerRun runs cmd in a new container of the image, waits for it to
+// exit and returns its combined output. The container, which has the
+// labels, is removed.
+func DockerRun(ctx context.Context, c *client.Client, image string, cmd []string, labels map[string]string) (string, error) {
+	resp, err := c.ContainerCreate(ctx, &container.Config{
+		Image:  image,
+		Cmd:    cmd,
+		Labels: labels,
+	}, nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := c.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			log.Printf("FATAL: leaked resources, got: %+v", err)
+		}
+	}()
+
+	if err := c.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		return "", err
+	}
+	exitCode, err := c.ContainerWait(ctx, resp.ID)
+	if err != nil {
+		return "", err
+	}
+
+	logs, err := c.ContainerLogs(ctx, resp.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer logs.Close()
+	var output bytes.Buffer
+	if _, err := stdcopy.StdCopy(&output, &output, logs); err != nil {
+		return output.String(), err
+	}
+	if exitCode != 0 {
+		return output.String(), fmt.Errorf("%q exited with code %d: %s",
+			strings.Join(cmd, " "), exitCode, strings.TrimSpace(output.String()))
+	}
+	return output.String(), nil
+}
+
+// DockerHostPort returns the host port that Docker published a container
+// port on. Ports bound without a host port get an ephemeral one when the
+// container starts, so the container must be running.
+func DockerHostPort(ctx context.Context, c *client.Client, containerID string, port nat.Port) (int, error) {
+	info, err := c.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return 0, err
+	}
+	if info.NetworkSettings == nil {
+		return 0, fmt.Errorf("container %q has no network settings", containerID)
+	}
+	for _, binding := range info.NetworkSettings.Ports[port] {
+		if binding.HostPort != "" {
+			return strconv.Atoi(binding.HostPort)
+		}
+	}
+	return 0, fmt.Errorf("port %s of container %q is not published", port, containerID)
+}
+
 // func NewDockerHost(c *client.Client, settings DockerConfig) (*DockerHost, error) {
 // 	resp, err := c.ContainerCreate(context.TODO(), client.Config{
 // 			Image:    settings.ImageWithTag(),
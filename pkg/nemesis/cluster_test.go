@@ -0,0 +1,39 @@
+package nemesis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/host"
+	"github.com/lego/roachnest/pkg/testutils"
+)
+
+func TestNemesis(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size:           3,
+		SetupToxiproxy: true,
+	})
+
+	ctx := context.Background()
+	n := New(ct.Cluster(), Config{
+		Interval:      time.Second,
+		FaultDuration: 5 * time.Second,
+		Logf:          t.Logf,
+	})
+	n.Start(ctx)
+	time.Sleep(time.Minute)
+	events, err := n.Stop()
+	if err != nil {
+		t.Fatalf("%v (seed %d)", err, n.Seed())
+	}
+	if len(events) == 0 {
+		t.Fatal("expected the nemesis to inject faults")
+	}
+
+	// Every fault is healed.
+	if err := ct.Cluster().WaitUntil(ctx, host.Running); err != nil {
+		t.Fatalf("%v (seed %d)", err, n.Seed())
+	}
+}
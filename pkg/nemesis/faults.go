@@ -0,0 +1,285 @@
+package nemesis
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/host"
+)
+
+// DefaultFaults returns the built-in faults. Partition and Latency need a
+// cluster with SetupToxiproxy, and New leaves them out of the default
+// menu of other clusters.
+func DefaultFaults() []Fault {
+	return []Fault{
+		KillRestart{},
+		Pause{},
+		Partition{},
+		Latency{Min: 50 * time.Millisecond, Max: 500 * time.Millisecond},
+		ResourceSqueeze{Resources: cluster.Resources{CPUs: 0.25}},
+		CancelSession{},
+	}
+}
+
+// needsToxiproxy reports whether the fault only works on a cluster with
+// SetupToxiproxy.
+func needsToxiproxy(f Fault) bool {
+	switch f.(type) {
+	case Partition, Latency:
+		return true
+	}
+	return false
+}
+
+// Every fault draws its random choices before acting on the cluster, so
+// that a failed fault uses as much randomness as a successful one.
+
+// randomNode picks a node of the cluster.
+func randomNode(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (cluster.NodeID, error) {
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return cluster.NodeID(rng.Intn(len(nodes))), nil
+}
+
+// KillRestart kills a node with SIGKILL, and restarts it to heal.
+type KillRestart struct{}
+
+func (KillRestart) Name() string { return "kill" }
+
+func (KillRestart) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	id, err := randomNode(ctx, c, rng)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.KillNode(ctx, id); err != nil {
+		return nil, err
+	}
+	return &Injection{
+		Detail: fmt.Sprintf("killed %s", id),
+		Heal: func(ctx context.Context) error {
+			return c.RestartNode(ctx, id)
+		},
+	}, nil
+}
+
+// Sweep restarts every stopped node.
+func (KillRestart) Sweep(ctx context.Context, c cluster.Cluster) error {
+	return forNodes(ctx, c, func(info cluster.NodeInfo) error {
+		if info.Status != host.Stopped {
+			return nil
+		}
+		return c.RestartNode(ctx, info.ID)
+	})
+}
+
+// forNodes calls fn with every node, and returns the first error.
+func forNodes(ctx context.Context, c cluster.Cluster, fn func(cluster.NodeInfo) error) error {
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		return err
+	}
+	var first error
+	for _, info := range nodes {
+		if err := fn(info); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Pause freezes a node, and unfreezes it to heal.
+type Pause struct{}
+
+func (Pause) Name() string { return "pause" }
+
+func (Pause) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	id, err := randomNode(ctx, c, rng)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.PauseNode(ctx, id); err != nil {
+		return nil, err
+	}
+	return &Injection{
+		Detail: fmt.Sprintf("paused %s", id),
+		Heal: func(ctx context.Context) error {
+			return c.UnpauseNode(ctx, id)
+		},
+	}, nil
+}
+
+// Sweep unfreezes every paused node.
+func (Pause) Sweep(ctx context.Context, c cluster.Cluster) error {
+	return forNodes(ctx, c, func(info cluster.NodeInfo) error {
+		if info.Status != host.Paused {
+			return nil
+		}
+		return c.UnpauseNode(ctx, info.ID)
+	})
+}
+
+// Partition splits a random minority of the nodes off from the rest.
+type Partition struct{}
+
+func (Partition) Name() string { return "partition" }
+
+func (Partition) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) < 2 {
+		return nil, fmt.Errorf("cannot partition %d nodes", len(nodes))
+	}
+	perm := rng.Perm(len(nodes))
+	// The minority is at most half of the nodes, and at least one.
+	maxSize := (len(nodes) - 1) / 2
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	size := 1 + rng.Intn(maxSize)
+	minority, majority := nodeIDs(perm[:size]), nodeIDs(perm[size:])
+	if err := c.Partition(ctx, minority, majority); err != nil {
+		return nil, err
+	}
+	return &Injection{
+		Detail: fmt.Sprintf("partitioned %v from %v", minority, majority),
+		Heal:   c.Heal,
+	}, nil
+}
+
+// Sweep heals every partitioned link.
+func (Partition) Sweep(ctx context.Context, c cluster.Cluster) error {
+	return c.Heal(ctx)
+}
+
+func nodeIDs(ids []int) []cluster.NodeID {
+	sort.Ints(ids)
+	nodeIDs := make([]cluster.NodeID, 0, len(ids))
+	for _, id := range ids {
+		nodeIDs = append(nodeIDs, cluster.NodeID(id))
+	}
+	return nodeIDs
+}
+
+// Latency adds between Min and Max of latency to every link of a node.
+type Latency struct {
+	Min, Max time.Duration
+}
+
+func (Latency) Name() string { return "latency" }
+
+func (l Latency) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	id, err := randomNode(ctx, c, rng)
+	if err != nil {
+		return nil, err
+	}
+	latency := l.Min
+	if l.Max > l.Min {
+		latency += time.Duration(rng.Int63n(int64(l.Max - l.Min)))
+	}
+	toxic, err := c.AddLatency(ctx, id, latency, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &Injection{
+		Detail: fmt.Sprintf("added %s of latency to %s", latency, id),
+		Heal: func(context.Context) error {
+			return toxic.Remove()
+		},
+	}, nil
+}
+
+// Sweep removes every toxic, which also heals partitions.
+func (Latency) Sweep(ctx context.Context, c cluster.Cluster) error {
+	return c.ResetAllToxics(ctx)
+}
+
+// ResourceSqueeze limits the resources of a node, and restores them to
+// heal.
+type ResourceSqueeze struct {
+	Resources cluster.Resources
+}
+
+func (ResourceSqueeze) Name() string { return "squeeze" }
+
+func (r ResourceSqueeze) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	id, err := randomNode(ctx, c, rng)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.UpdateResources(ctx, id, r.Resources); err != nil {
+		return nil, err
+	}
+	return &Injection{
+		Detail: fmt.Sprintf("squeezed %s to %+v", id, r.Resources),
+		Heal: func(ctx context.Context) error {
+			return c.RestoreResources(ctx, id)
+		},
+	}, nil
+}
+
+// Sweep restores the resources of every running node.
+func (ResourceSqueeze) Sweep(ctx context.Context, c cluster.Cluster) error {
+	return forNodes(ctx, c, func(info cluster.NodeInfo) error {
+		if info.Status != host.Running {
+			return nil
+		}
+		return c.RestoreResources(ctx, info.ID)
+	})
+}
+
+// CancelSession cancels a random SQL session of the clients of the
+// cluster. Sessions heal themselves, as clients reconnect.
+type CancelSession struct{}
+
+func (CancelSession) Name() string { return "cancel-session" }
+
+// cancelAppName is the application name of the connection that cancels
+// sessions, so that it does not cancel itself.
+const cancelAppName = "roachnest-nemesis"
+
+func (CancelSession) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	// The session is picked among the sessions at the time, which differ
+	// from run to run, so only the draw is replayed.
+	pick := rng.Float64()
+
+	db, err := c.Connect(ctx, cluster.ConnOptions{ApplicationName: cancelAppName})
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.QueryContext(ctx,
+		`SELECT session_id FROM [SHOW CLUSTER SESSIONS] WHERE application_name != $1 ORDER BY session_id`,
+		cancelAppName,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var sessions []string
+	for rows.Next() {
+		var session string
+		if err := rows.Scan(&session); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return &Injection{Detail: "no session to cancel"}, nil
+	}
+
+	session := sessions[int(pick*float64(len(sessions)))]
+	if _, err := db.ExecContext(ctx, "CANCEL SESSION $1", session); err != nil {
+		return nil, err
+	}
+	return &Injection{Detail: fmt.Sprintf("cancelled session %s", session)}, nil
+}
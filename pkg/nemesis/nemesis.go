@@ -0,0 +1,275 @@
+package nemesis
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+)
+
+// Fault is a kind of fault the nemesis can inject. Every random choice of
+// Inject, e.g. which node to kill, must be drawn from rng, so that runs
+// with the same seed inject the same faults.
+type Fault interface {
+	// Name identifies the fault in the events of the nemesis.
+	Name() string
+	// Inject applies the fault to the cluster.
+	Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error)
+}
+
+// Sweeper is a Fault that can undo any injection of its kind, e.g. after
+// an injection was cut short or failed to heal. Nemesis.Stop sweeps with
+// every fault of the menu that is a Sweeper.
+type Sweeper interface {
+	Sweep(ctx context.Context, c cluster.Cluster) error
+}
+
+// Injection is a fault that was applied to the cluster.
+type Injection struct {
+	// Detail describes what was done, e.g. which node was killed.
+	Detail string
+	// Heal undoes the fault. It may be nil for faults that heal
+	// themselves, e.g. a cancelled session.
+	Heal func(context.Context) error
+}
+
+// Config configures a nemesis.
+type Config struct {
+	// Seed is the seed of every random choice of the nemesis. Zero picks
+	// one, which is logged so that the run can be replayed.
+	Seed int64
+	// Faults is the menu of faults to pick from. It defaults to
+	// DefaultFaults, without those that need toxiproxy if the cluster
+	// has none.
+	Faults []Fault
+	// Interval is how long the cluster is left alone between faults, and
+	// FaultDuration how long each fault lasts before it is healed. They
+	// default to 10s.
+	Interval      time.Duration
+	FaultDuration time.Duration
+	// Logf logs every action. It defaults to log.Printf.
+	Logf func(format string, args ...interface{})
+}
+
+const defaultPeriod = 10 * time.Second
+
+// Event is an action of the nemesis.
+type Event struct {
+	Time time.Time
+	// Fault is the name of the fault, and Action "inject", "heal" or
+	// "sweep".
+	Fault  string
+	Action string
+	Detail string
+	Err    error
+}
+
+func (e Event) String() string {
+	s := fmt.Sprintf("%s %s %s", e.Time.Format(time.RFC3339Nano), e.Action, e.Fault)
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
+	if e.Err != nil {
+		s += fmt.Sprintf(" failed: %v", e.Err)
+	}
+	return s
+}
+
+// Nemesis injects faults picked at random from a menu into a cluster, one
+// at a time, until it is stopped.
+type Nemesis struct {
+	c      cluster.Cluster
+	config Config
+	rng    *rand.Rand
+
+	cancel func()
+	done   chan struct{}
+	// unhealed are the injections whose heal failed, to retry. It is
+	// only used by run, and by Stop once run returned.
+	unhealed []unhealed
+
+	// mu protects events.
+	mu     sync.Mutex
+	events []Event
+}
+
+// New returns a nemesis for the cluster. It does nothing until Start.
+func New(c cluster.Cluster, config Config) *Nemesis {
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	if config.Faults == nil {
+		for _, f := range DefaultFaults() {
+			if needsToxiproxy(f) && !c.Settings().SetupToxiproxy {
+				continue
+			}
+			config.Faults = append(config.Faults, f)
+		}
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultPeriod
+	}
+	if config.FaultDuration == 0 {
+		config.FaultDuration = defaultPeriod
+	}
+	if config.Logf == nil {
+		config.Logf = log.Printf
+	}
+	n := &Nemesis{
+		c:      c,
+		config: config,
+		rng:    rand.New(rand.NewSource(config.Seed)),
+	}
+	n.config.Logf("nemesis seed is %d, set Config.Seed to it to replay this run", config.Seed)
+	return n
+}
+
+// Seed is the seed of the nemesis.
+func (n *Nemesis) Seed() int64 {
+	return n.config.Seed
+}
+
+// Start starts injecting faults in the background.
+func (n *Nemesis) Start(ctx context.Context) {
+	ctx, n.cancel = context.WithCancel(ctx)
+	n.done = make(chan struct{})
+	go func() {
+		defer close(n.done)
+		n.run(ctx)
+	}()
+}
+
+// Stop stops injecting faults, heals the current one, retries the heals
+// that failed, sweeps with every Sweeper of the menu and returns every
+// event. It returns an error if the cluster could not be healed.
+func (n *Nemesis) Stop() ([]Event, error) {
+	if n.cancel == nil {
+		// Never started.
+		return n.Events(), nil
+	}
+	n.cancel()
+	<-n.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), healTimeout)
+	defer cancel()
+	var errs []string
+	n.retryHeals(ctx)
+	for _, u := range n.unhealed {
+		errs = append(errs, fmt.Sprintf("%s: %s", u.fault, u.injection.Detail))
+	}
+	swept := make(map[string]bool)
+	for _, f := range n.config.Faults {
+		sweeper, ok := f.(Sweeper)
+		if !ok || swept[f.Name()] {
+			continue
+		}
+		swept[f.Name()] = true
+		err := sweeper.Sweep(ctx, n.c)
+		n.record(Event{Fault: f.Name(), Action: "sweep", Err: err})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("sweeping %s: %v", f.Name(), err))
+		}
+	}
+	events := n.Events()
+	if len(errs) > 0 {
+		return events, fmt.Errorf("nemesis failed to heal the cluster: %s", strings.Join(errs, "; "))
+	}
+	return events, nil
+}
+
+// unhealed is an injection whose heal failed.
+type unhealed struct {
+	fault     string
+	injection *Injection
+}
+
+// retryHeals retries the heals that failed, and keeps those that fail
+// again.
+func (n *Nemesis) retryHeals(ctx context.Context) {
+	var still []unhealed
+	for _, u := range n.unhealed {
+		err := u.injection.Heal(ctx)
+		n.record(Event{Fault: u.fault, Action: "heal", Detail: u.injection.Detail, Err: err})
+		if err != nil {
+			still = append(still, u)
+		}
+	}
+	n.unhealed = still
+}
+
+// Events returns the events so far.
+func (n *Nemesis) Events() []Event {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]Event(nil), n.events...)
+}
+
+func (n *Nemesis) run(ctx context.Context) {
+	for {
+		if !sleep(ctx, n.config.Interval) {
+			return
+		}
+		if len(n.unhealed) > 0 {
+			// Faults are injected one at a time, so the next one waits
+			// until the cluster is healed.
+			healCtx, cancel := context.WithTimeout(ctx, healTimeout)
+			n.retryHeals(healCtx)
+			cancel()
+			if len(n.unhealed) > 0 {
+				continue
+			}
+		}
+		fault := n.config.Faults[n.rng.Intn(len(n.config.Faults))]
+		injection, err := fault.Inject(ctx, n.c, n.rng)
+		if err != nil {
+			// The fault may have been applied in part, e.g. if ctx was
+			// cancelled in the middle, which Stop sweeps up.
+			n.record(Event{Fault: fault.Name(), Action: "inject", Err: err})
+			continue
+		}
+		n.record(Event{Fault: fault.Name(), Action: "inject", Detail: injection.Detail})
+		if injection.Heal == nil {
+			continue
+		}
+
+		stopped := !sleep(ctx, n.config.FaultDuration)
+		// Heal even once stopped, with a context of its own.
+		healCtx, cancel := context.WithTimeout(context.Background(), healTimeout)
+		err = injection.Heal(healCtx)
+		cancel()
+		n.record(Event{Fault: fault.Name(), Action: "heal", Detail: injection.Detail, Err: err})
+		if err != nil {
+			n.unhealed = append(n.unhealed, unhealed{fault: fault.Name(), injection: injection})
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// healTimeout bounds healing a fault, e.g. waiting for a killed node to
+// restart.
+const healTimeout = 2 * time.Minute
+
+func (n *Nemesis) record(e Event) {
+	e.Time = time.Now()
+	n.config.Logf("nemesis: %s", e)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, e)
+}
+
+// sleep waits for d, and reports false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
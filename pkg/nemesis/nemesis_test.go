@@ -0,0 +1,168 @@
+package nemesis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+)
+
+// drawFault injects nothing, and only records a draw of the rng.
+type drawFault struct {
+	name string
+}
+
+func (f drawFault) Name() string { return f.name }
+
+func (f drawFault) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	return &Injection{
+		Detail: fmt.Sprint(rng.Intn(1000)),
+		Heal:   func(context.Context) error { return nil },
+	}, nil
+}
+
+func runDraws(t *testing.T, seed int64) []string {
+	n := New(nil, Config{
+		Seed:          seed,
+		Faults:        []Fault{drawFault{"a"}, drawFault{"b"}, drawFault{"c"}},
+		Interval:      time.Millisecond,
+		FaultDuration: time.Millisecond,
+		Logf:          t.Logf,
+	})
+	n.Start(context.Background())
+	for len(n.Events()) < 20 {
+		time.Sleep(time.Millisecond)
+	}
+	events, err := n.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var draws []string
+	for _, e := range events[:20] {
+		draws = append(draws, e.Fault+e.Action+e.Detail)
+	}
+	return draws
+}
+
+func TestSeedReplay(t *testing.T) {
+	first, second := runDraws(t, 42), runDraws(t, 42)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("expected the same faults with the same seed, got\n%v\n%v", first, second)
+	}
+	if other := runDraws(t, 43); reflect.DeepEqual(first, other) {
+		t.Fatalf("expected other faults with another seed, got %v", other)
+	}
+}
+
+// flakyFault fails to heal the first time, and counts its heals and
+// sweeps.
+type flakyFault struct {
+	mu      sync.Mutex
+	heals   int
+	healed  int
+	sweeps  int
+	injects int
+}
+
+func (f *flakyFault) Name() string { return "flaky" }
+
+func (f *flakyFault) Inject(ctx context.Context, c cluster.Cluster, rng *rand.Rand) (*Injection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.injects++
+	return &Injection{Heal: func(context.Context) error {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.heals++
+		if f.heals == 1 {
+			return errors.New("heal failed")
+		}
+		f.healed++
+		return nil
+	}}, nil
+}
+
+func (f *flakyFault) Sweep(ctx context.Context, c cluster.Cluster) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sweeps++
+	return nil
+}
+
+func TestHealRetry(t *testing.T) {
+	f := &flakyFault{}
+	n := New(nil, Config{
+		Faults:        []Fault{f},
+		Interval:      time.Millisecond,
+		FaultDuration: time.Millisecond,
+		Logf:          t.Logf,
+	})
+	n.Start(context.Background())
+	for {
+		f.mu.Lock()
+		heals := f.heals
+		f.mu.Unlock()
+		if heals >= 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := n.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// Every injection was healed in the end, the first one on a retry.
+	if f.healed != f.injects {
+		t.Errorf("healed %d of %d injections", f.healed, f.injects)
+	}
+	if f.sweeps != 1 {
+		t.Errorf("expected a sweep on stop, got %d", f.sweeps)
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	n := New(nil, Config{Faults: []Fault{drawFault{"a"}}, Logf: t.Logf})
+	if events, err := n.Stop(); err != nil || len(events) != 0 {
+		t.Fatalf("expected no events and no error, got %v, %v", events, err)
+	}
+}
+
+// settingsCluster is a cluster that only reports its settings.
+type settingsCluster struct {
+	cluster.Cluster
+	settings cluster.Settings
+}
+
+func (c settingsCluster) Settings() cluster.Settings { return c.settings }
+
+func TestDefaultFaults(t *testing.T) {
+	for _, tc := range []struct {
+		settings cluster.Settings
+		want     []string
+	}{
+		{
+			cluster.Settings{Size: 3},
+			[]string{"kill", "pause", "squeeze", "cancel-session"},
+		},
+		{
+			cluster.Settings{Size: 3, SetupToxiproxy: true},
+			[]string{"kill", "pause", "partition", "latency", "squeeze", "cancel-session"},
+		},
+	} {
+		n := New(settingsCluster{settings: tc.settings}, Config{Logf: t.Logf})
+		var names []string
+		for _, f := range n.config.Faults {
+			names = append(names, f.Name())
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("SetupToxiproxy=%t: expected the faults %v, got %v", tc.settings.SetupToxiproxy, tc.want, names)
+		}
+	}
+}
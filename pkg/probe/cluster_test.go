@@ -0,0 +1,45 @@
+package probe
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/testutils"
+)
+
+func TestAvailability(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	p, err := New(ctx, c, Config{Keys: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Start(ctx)
+	time.Sleep(5 * time.Second)
+	p.Mark("kill n1")
+	if err := c.KillNode(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Second)
+	p.Mark("restart n1")
+	if err := c.RestartNode(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Second)
+	report := p.Stop()
+	t.Log(report)
+
+	for _, fr := range report.ByFault() {
+		for _, kind := range []Kind{Read, Write} {
+			if recovery := fr.Recovery(kind); recovery > 10*time.Second {
+				t.Errorf("%s took %s to recover after %s", kind, recovery, fr.Fault.Name)
+			}
+		}
+	}
+}
@@ -0,0 +1,261 @@
+// Package probe measures the availability of a cluster: it reads and
+// writes continuously through several gateways, and reports the
+// intervals during which they failed, e.g. after a node was killed.
+package probe
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+)
+
+// Kind is the kind of operation of a probe.
+type Kind string
+
+const (
+	Read  Kind = "read"
+	Write Kind = "write"
+)
+
+// Config configures a Probe.
+type Config struct {
+	// Database and Table are where the probes read and write. The table
+	// has an INT primary key k and an INT column v, and is created if it
+	// does not exist. Table defaults to probe.
+	Database string
+	Table    string
+	// Keys is the number of keys that are probed in turn, so that the
+	// probes cover a key range rather than a single key. It defaults
+	// to 1.
+	Keys int
+	// Gateways are the nodes that probes go through. They default to
+	// every node.
+	Gateways []cluster.NodeID
+	// Interval is how often every gateway is probed for each kind. It
+	// defaults to 100ms.
+	Interval time.Duration
+	// Timeout fails probes that take longer than it, so that a blocked
+	// probe counts as unavailability. It defaults to 1s.
+	Timeout time.Duration
+}
+
+const (
+	defaultTable    = "probe"
+	defaultInterval = 100 * time.Millisecond
+	defaultTimeout  = time.Second
+)
+
+// Sample is the outcome of a probe.
+type Sample struct {
+	Gateway cluster.NodeID
+	Kind    Kind
+	Start   time.Time
+	Latency time.Duration
+	Err     error
+}
+
+// End is when the probe completed.
+func (s Sample) End() time.Time {
+	return s.Start.Add(s.Latency)
+}
+
+// Fault is a fault injected while probing, to report the outages that
+// follow it.
+type Fault struct {
+	Name string
+	Time time.Time
+}
+
+// Probe reads and writes through the gateways of a cluster until it is
+// stopped.
+type Probe struct {
+	c      cluster.Cluster
+	config Config
+
+	start  time.Time
+	cancel func()
+	wg     sync.WaitGroup
+
+	// mu protects samples and marks.
+	mu      sync.Mutex
+	samples []Sample
+	marks   []Fault
+}
+
+// New returns a probe of the cluster, and creates its table. It does
+// nothing until Start.
+func New(ctx context.Context, c cluster.Cluster, config Config) (*Probe, error) {
+	if config.Table == "" {
+		config.Table = defaultTable
+	}
+	if config.Keys == 0 {
+		config.Keys = 1
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultInterval
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Gateways == nil {
+		nodes, err := c.Nodes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range nodes {
+			config.Gateways = append(config.Gateways, info.ID)
+		}
+	}
+	db, err := c.Connect(ctx, cluster.ConnOptions{Database: config.Database})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (k INT PRIMARY KEY, v INT NOT NULL)", config.Table,
+	)); err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, fmt.Sprintf(
+		"UPSERT INTO %s SELECT k, 0 FROM generate_series(0, $1) AS g(k)", config.Table,
+	), config.Keys-1); err != nil {
+		return nil, err
+	}
+	return &Probe{c: c, config: config}, nil
+}
+
+// Start starts probing in the background, with a reader and a writer
+// per gateway.
+func (p *Probe) Start(ctx context.Context) {
+	ctx, p.cancel = context.WithCancel(ctx)
+	p.start = time.Now()
+	for _, gateway := range p.config.Gateways {
+		for _, kind := range []Kind{Read, Write} {
+			p.wg.Add(1)
+			go func(gateway cluster.NodeID, kind Kind) {
+				defer p.wg.Done()
+				p.run(ctx, gateway, kind)
+			}(gateway, kind)
+		}
+	}
+}
+
+// Mark records that a fault is injected now, e.g. right before killing
+// a node, for Report.ByFault.
+func (p *Probe) Mark(name string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.marks = append(p.marks, Fault{Name: name, Time: time.Now()})
+}
+
+// Stop stops probing, and reports every sample.
+func (p *Probe) Stop() *Report {
+	p.cancel()
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return &Report{
+		Start:   p.start,
+		End:     time.Now(),
+		Samples: append([]Sample(nil), p.samples...),
+		Marks:   append([]Fault(nil), p.marks...),
+	}
+}
+
+func (p *Probe) run(ctx context.Context, gateway cluster.NodeID, kind Kind) {
+	// Every reader and writer has a connection of its own, rather than
+	// one shared through Connect, so that probes of one gateway never
+	// wait on another.
+	conn := &probeConn{}
+	defer conn.close()
+	ticker := time.NewTicker(p.config.Interval)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		start := time.Now()
+		probeCtx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+		err := p.probe(probeCtx, conn, gateway, kind, i%p.config.Keys, i)
+		cancel()
+		if ctx.Err() != nil {
+			// Probes cut short by Stop tell nothing.
+			return
+		}
+		p.mu.Lock()
+		p.samples = append(p.samples, Sample{
+			Gateway: gateway,
+			Kind:    kind,
+			Start:   start,
+			Latency: time.Since(start),
+			Err:     err,
+		})
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeConn is the connection of a reader or writer, and the URL it was
+// opened with.
+type probeConn struct {
+	dsn string
+	db  *sql.DB
+}
+
+// get returns a connection to the URL, and replaces the connection if
+// the URL changed, e.g. when the gateway restarted on another port.
+func (pc *probeConn) get(dsn string) (*sql.DB, error) {
+	if pc.db != nil && pc.dsn == dsn {
+		return pc.db, nil
+	}
+	pc.close()
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	pc.dsn, pc.db = dsn, db
+	return db, nil
+}
+
+func (pc *probeConn) close() {
+	if pc.db != nil {
+		pc.db.Close()
+		pc.db = nil
+	}
+}
+
+func (p *Probe) probe(ctx context.Context, pc *probeConn, gateway cluster.NodeID, kind Kind, key, value int) error {
+	// The URL is looked up every time, as it changes when the gateway
+	// restarts.
+	dsn, err := p.c.DSN(cluster.ConnOptions{
+		Node:            gateway,
+		Database:        p.config.Database,
+		ApplicationName: "roachnest_probe",
+	})
+	if err != nil {
+		return err
+	}
+	db, err := pc.get(dsn)
+	if err != nil {
+		return err
+	}
+	if kind == Write {
+		_, err := db.ExecContext(ctx,
+			fmt.Sprintf("UPDATE %s SET v = $1 WHERE k = $2", p.config.Table), value, key,
+		)
+		return err
+	}
+	var v int
+	err = db.QueryRowContext(ctx,
+		fmt.Sprintf("SELECT v FROM %s WHERE k = $1", p.config.Table), key,
+	).Scan(&v)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("key %d of %s is missing", key, p.config.Table)
+	}
+	return err
+}
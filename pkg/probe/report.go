@@ -0,0 +1,220 @@
+package probe
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/nemesis"
+)
+
+// Report is every sample of a probe, from which outages are worked out.
+type Report struct {
+	Start, End time.Time
+	Samples    []Sample
+	// Marks are the faults recorded with Probe.Mark.
+	Marks []Fault
+}
+
+// Outage is an interval during which probes failed. It starts when the
+// first failed probe started, and ends when the next successful probe
+// completed. An Ongoing outage had not ended when the probe stopped.
+type Outage struct {
+	Start, End time.Time
+	Ongoing    bool
+}
+
+func (o Outage) Duration() time.Duration {
+	return o.End.Sub(o.Start)
+}
+
+func (o Outage) String() string {
+	s := fmt.Sprintf("%s for %s", o.Start.Format("15:04:05.000"), o.Duration())
+	if o.Ongoing {
+		s += " (ongoing)"
+	}
+	return s
+}
+
+// GatewayOutages returns the outages of a kind of probe through a
+// gateway.
+func (r *Report) GatewayOutages(gateway cluster.NodeID, kind Kind) []Outage {
+	var samples []Sample
+	for _, s := range r.Samples {
+		if s.Gateway == gateway && s.Kind == kind {
+			samples = append(samples, s)
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i].Start.Before(samples[j].Start) })
+
+	var outages []Outage
+	var current *Outage
+	for _, s := range samples {
+		switch {
+		case s.Err != nil && current == nil:
+			current = &Outage{Start: s.Start}
+		case s.Err == nil && current != nil:
+			current.End = s.End()
+			outages = append(outages, *current)
+			current = nil
+		}
+	}
+	if current != nil {
+		current.End, current.Ongoing = r.End, true
+		outages = append(outages, *current)
+	}
+	return outages
+}
+
+// Outages returns the outages of a kind of probe through every gateway
+// at once, during which the cluster could not serve them at all. A
+// gateway that is down on its own does not make an outage.
+func (r *Report) Outages(kind Kind) []Outage {
+	gateways := make(map[cluster.NodeID]bool)
+	for _, s := range r.Samples {
+		gateways[s.Gateway] = true
+	}
+	if len(gateways) == 0 {
+		return nil
+	}
+	// The whole run is an outage to start with, which every gateway cuts
+	// down to when it was out as well.
+	outages := []Outage{{Start: r.Start, End: r.End, Ongoing: true}}
+	for gateway := range gateways {
+		outages = intersect(outages, r.GatewayOutages(gateway, kind))
+	}
+	return outages
+}
+
+// intersect returns the intervals during which there are outages in both
+// lists, which are sorted.
+func intersect(a, b []Outage) []Outage {
+	var out []Outage
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		start, end := a[i].Start, a[i].End
+		if b[j].Start.After(start) {
+			start = b[j].Start
+		}
+		if b[j].End.Before(end) {
+			end = b[j].End
+		}
+		if start.Before(end) {
+			out = append(out, Outage{
+				Start:   start,
+				End:     end,
+				Ongoing: a[i].Ongoing && b[j].Ongoing && a[i].End.Equal(b[j].End),
+			})
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return out
+}
+
+// FaultReport is the outages that followed a fault, until the next one.
+// An outage that lasts past the next fault is in the reports of both.
+type FaultReport struct {
+	Fault Fault
+	// Until is the time of the next fault, or the end of the probe.
+	Until   time.Time
+	Outages map[Kind][]Outage
+}
+
+// Unavailable is how long a kind of probe was unavailable between the
+// fault and the next one, in total.
+func (fr FaultReport) Unavailable(kind Kind) time.Duration {
+	var total time.Duration
+	for _, o := range fr.Outages[kind] {
+		start, end := o.Start, o.End
+		if start.Before(fr.Fault.Time) {
+			start = fr.Fault.Time
+		}
+		if end.After(fr.Until) {
+			end = fr.Until
+		}
+		if end.After(start) {
+			total += end.Sub(start)
+		}
+	}
+	return total
+}
+
+// Recovery is how long it took after the fault for the last outage of a
+// kind of probe to end, or zero if there was none. It runs past the next
+// fault if the outage does.
+func (fr FaultReport) Recovery(kind Kind) time.Duration {
+	outages := fr.Outages[kind]
+	if len(outages) == 0 {
+		return 0
+	}
+	recovery := outages[len(outages)-1].End.Sub(fr.Fault.Time)
+	if recovery < 0 {
+		return 0
+	}
+	return recovery
+}
+
+// ByFault splits the outages between the faults, which are sorted by
+// time. The outages after a fault are those that overlap with the time
+// until the next one. It defaults to the Marks.
+func (r *Report) ByFault(faults ...Fault) []FaultReport {
+	if faults == nil {
+		faults = r.Marks
+	}
+	outages := map[Kind][]Outage{
+		Read:  r.Outages(Read),
+		Write: r.Outages(Write),
+	}
+	reports := make([]FaultReport, 0, len(faults))
+	for i, f := range faults {
+		until := r.End
+		if i+1 < len(faults) {
+			until = faults[i+1].Time
+		}
+		fr := FaultReport{Fault: f, Until: until, Outages: make(map[Kind][]Outage)}
+		for kind, kindOutages := range outages {
+			for _, o := range kindOutages {
+				if o.End.After(f.Time) && o.Start.Before(until) {
+					fr.Outages[kind] = append(fr.Outages[kind], o)
+				}
+			}
+		}
+		reports = append(reports, fr)
+	}
+	return reports
+}
+
+// NemesisFaults returns the faults that a nemesis injected, from its
+// events.
+func NemesisFaults(events []nemesis.Event) []Fault {
+	var faults []Fault
+	for _, e := range events {
+		if e.Action == "inject" && e.Err == nil {
+			name := e.Fault
+			if e.Detail != "" {
+				name += ": " + e.Detail
+			}
+			faults = append(faults, Fault{Name: name, Time: e.Time})
+		}
+	}
+	return faults
+}
+
+// String formats the outages after every mark.
+func (r *Report) String() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%d probes over %s", len(r.Samples), r.End.Sub(r.Start))
+	for _, fr := range r.ByFault() {
+		fmt.Fprintf(&b, "\n%s at %s:", fr.Fault.Name, fr.Fault.Time.Format("15:04:05.000"))
+		for _, kind := range []Kind{Write, Read} {
+			fmt.Fprintf(&b, "\n  %s: unavailable for %s, recovered after %s %v",
+				kind, fr.Unavailable(kind), fr.Recovery(kind), fr.Outages[kind])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,117 @@
+package probe
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+)
+
+func TestOutages(t *testing.T) {
+	start := time.Now()
+	at := func(s float64) time.Time {
+		return start.Add(time.Duration(s * float64(time.Second)))
+	}
+	r := &Report{Start: start, End: at(30)}
+	errDown := errors.New("down")
+	// sample records probes of a gateway every second, failing between
+	// from and to, which take 100ms.
+	sample := func(gateway cluster.NodeID, kind Kind, from, to float64) {
+		for s := 0.0; s < 30; s++ {
+			var err error
+			if s >= from && s < to {
+				err = errDown
+			}
+			r.Samples = append(r.Samples, Sample{Gateway: gateway, Kind: kind, Start: at(s), Latency: 100 * time.Millisecond, Err: err})
+		}
+	}
+	// Node 1 is killed at 5s, and never comes back. Writes through the
+	// other gateways fail until 9s and 10s, and reads never do.
+	sample(0, Write, 5, 9)
+	sample(1, Write, 5, 30)
+	sample(2, Write, 6, 10)
+	sample(0, Read, 0, 0)
+	sample(1, Read, 5, 30)
+	sample(2, Read, 0, 0)
+	// A second fault at 20s only takes down writes through node 0.
+	for i := range r.Samples {
+		s := &r.Samples[i]
+		if s.Gateway == 0 && s.Kind == Write && !s.Start.Before(at(20)) && s.Start.Before(at(25)) {
+			s.Err = errDown
+		}
+	}
+
+	gateway := r.GatewayOutages(1, Write)
+	if len(gateway) != 1 || !gateway[0].Ongoing || !gateway[0].Start.Equal(at(5)) {
+		t.Errorf("unexpected outages of node 1: %v", gateway)
+	}
+	writes := r.Outages(Write)
+	if len(writes) != 1 || !writes[0].Start.Equal(at(6)) || !writes[0].End.Equal(at(9.1)) || writes[0].Ongoing {
+		t.Fatalf("unexpected write outages: %v", writes)
+	}
+	if reads := r.Outages(Read); len(reads) != 0 {
+		t.Fatalf("unexpected read outages: %v", reads)
+	}
+
+	r.Marks = []Fault{{Name: "kill n1", Time: at(5)}, {Name: "partition n0", Time: at(20)}}
+	reports := r.ByFault()
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 fault reports, got %d", len(reports))
+	}
+	kill := reports[0]
+	if got, want := kill.Recovery(Write), 4100*time.Millisecond; got != want {
+		t.Errorf("recovery of writes after the kill is %s, expected %s", got, want)
+	}
+	if got, want := kill.Unavailable(Write), 3100*time.Millisecond; got != want {
+		t.Errorf("writes were unavailable for %s after the kill, expected %s", got, want)
+	}
+	if got := kill.Recovery(Read); got != 0 {
+		t.Errorf("recovery of reads after the kill is %s, expected none", got)
+	}
+	if got := reports[1].Unavailable(Write); got != 0 {
+		t.Errorf("writes were unavailable for %s after the partition, expected none", got)
+	}
+}
+
+func TestOutageOverFaults(t *testing.T) {
+	start := time.Now()
+	at := func(s float64) time.Time {
+		return start.Add(time.Duration(s * float64(time.Second)))
+	}
+	// Writes through the only gateway fail from 5s to 15s, across a kill
+	// at 5s and a partition at 10s.
+	r := &Report{Start: start, End: at(30)}
+	for s := 0.0; s < 30; s++ {
+		var err error
+		if s >= 5 && s < 15 {
+			err = errors.New("down")
+		}
+		r.Samples = append(r.Samples, Sample{Gateway: 0, Kind: Write, Start: at(s), Latency: 100 * time.Millisecond, Err: err})
+	}
+	r.Marks = []Fault{{Name: "kill n1", Time: at(5)}, {Name: "partition n0", Time: at(10)}}
+
+	reports := r.ByFault()
+	if len(reports) != 2 {
+		t.Fatalf("expected 2 fault reports, got %d", len(reports))
+	}
+	for i, tc := range []struct {
+		unavailable, recovery time.Duration
+	}{
+		// The outage is split between the faults, and neither recovered
+		// before it ended.
+		{5 * time.Second, 10100 * time.Millisecond},
+		{5100 * time.Millisecond, 5100 * time.Millisecond},
+	} {
+		fr := reports[i]
+		if len(fr.Outages[Write]) != 1 {
+			t.Fatalf("%s: expected the outage, got %v", fr.Fault.Name, fr.Outages[Write])
+		}
+		if got := fr.Unavailable(Write); got != tc.unavailable {
+			t.Errorf("%s: unavailable for %s, expected %s", fr.Fault.Name, got, tc.unavailable)
+		}
+		if got := fr.Recovery(Write); got != tc.recovery {
+			t.Errorf("%s: recovered after %s, expected %s", fr.Fault.Name, got, tc.recovery)
+		}
+	}
+}
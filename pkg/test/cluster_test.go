@@ -1,12 +1,20 @@
 package test
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/host"
 	"github.com/lego/roachnest/pkg/testutils"
+	"github.com/moby/moby/client"
 )
 
 func TestCluster(t *testing.T) {
@@ -21,7 +29,6 @@ func TestCluster(t *testing.T) {
 			Tag:         "latest",
 		},
 	})
-	// defer ct.Cleanup()
 
 	ct.LoadSchema(testutils.SchemaConfig{
 		SchemaCreator: func(db *sql.DB, gen *testutils.NameGenerator) error {
@@ -48,3 +55,627 @@ func TestCluster(t *testing.T) {
 		},
 	})
 }
+
+func TestNodeLifecycle(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	if err := c.KillNode(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes[2].Status != host.Stopped {
+		t.Fatalf("expected n2 to be %s, got %s", host.Stopped, nodes[2].Status)
+	}
+
+	db, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE lifecycle"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.RestartNode(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StopNode(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartNode(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err = c.Nodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.Status != host.Running {
+			t.Errorf("expected %s to be %s, got %s", node.Name, host.Running, node.Status)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size:           3,
+		SetupToxiproxy: true,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	db, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The majority side keeps serving writes.
+	if err := c.Partition(ctx, []cluster.NodeID{0, 1}, []cluster.NodeID{2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE partitioned"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Heal(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.PartitionOneWay(ctx, 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Heal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitUntil(ctx, host.Running); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestToxics(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size:           3,
+		SetupToxiproxy: true,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	db, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	latency, err := c.AddLatency(ctx, cluster.NodeID(2), 50*time.Millisecond, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer latency.Remove()
+	if _, err := c.LimitBandwidth(ctx, cluster.Link{From: 0, To: 1}, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE toxic"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := latency.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResetAllToxics(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitUntil(ctx, host.Running); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientToxics(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size:         3,
+		ProxyClients: true,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	db, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reset, err := c.ResetPeer(ctx, cluster.Link{From: cluster.Client, To: 0}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "SELECT 1"); err == nil {
+		t.Fatal("expected the connection to be reset")
+	}
+	if err := reset.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pool recovers once the gateway is reachable again.
+	if _, err := db.ExecContext(ctx, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGateways(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	for i := 0; i < 3; i++ {
+		id := cluster.NodeID(i)
+		t.Logf("%s: sql=%s admin=%s", id, c.Node(id).SQLAddr(), c.Node(id).AdminURL())
+		db, err := c.GetConnectionTo(ctx, id, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.ExecContext(ctx, "SELECT 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queries keep going through another gateway without n0.
+	if err := c.KillNode(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	db, err := c.GetConnectionTo(ctx, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE failover"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnOptions(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	root, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.ExecContext(ctx, "CREATE DATABASE conns"); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := c.Connect(ctx, cluster.ConnOptions{
+		Node:            1,
+		Database:        "conns",
+		ApplicationName: "conn_options",
+		MaxOpenConns:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var database, appName string
+	if err := db.QueryRowContext(ctx, "SHOW database").Scan(&database); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRowContext(ctx, "SHOW application_name").Scan(&appName); err != nil {
+		t.Fatal(err)
+	}
+	if database != "conns" || appName != "conn_options" {
+		t.Fatalf("expected database conns and application conn_options, got %s and %s", database, appName)
+	}
+
+	dsn, err := c.DSN(cluster.ConnOptions{Node: 2, Database: "conns"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("n2 DSN: %s", dsn)
+}
+
+func TestSecure(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size:   3,
+		Secure: true,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	root, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.ExecContext(ctx, "CREATE USER alice WITH PASSWORD 'hunter2'"); err != nil {
+		t.Fatal(err)
+	}
+
+	alice, err := c.Connect(ctx, cluster.ConnOptions{User: "alice", Password: "hunter2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.ExecContext(ctx, "CREATE DATABASE secure"); err == nil {
+		t.Fatal("expected alice not to be allowed to create a database")
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := c.RotateNodeCert(ctx, cluster.NodeID(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.WaitUntil(ctx, host.Running); err != nil {
+		t.Fatal(err)
+	}
+
+	// Readiness of a restarted node is checked with certificates too.
+	if err := c.StopNode(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestartNode(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.WaitUntil(ctx, host.Running); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegions(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Regions: []cluster.Region{
+			{Name: "us-east", Zones: []string{"us-east-a", "us-east-b"}, Nodes: 2},
+			{Name: "eu-west", Zones: []string{"eu-west-a"}, Nodes: 1},
+		},
+		Latencies: map[cluster.RegionPair]time.Duration{
+			{A: "us-east", B: "eu-west"}: 80 * time.Millisecond,
+		},
+		SetupToxiproxy: true,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("expected 3 nodes, got %d", len(nodes))
+	}
+	if expected := "region=eu-west,zone=eu-west-a"; nodes[2].Locality != expected {
+		t.Fatalf("expected n2 in %s, got %s", expected, nodes[2].Locality)
+	}
+
+	db, err := c.GetConnectionTo(ctx, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var locality string
+	if err := db.QueryRowContext(ctx, "SHOW LOCALITY").Scan(&locality); err != nil {
+		t.Fatal(err)
+	}
+	if locality != nodes[2].Locality {
+		t.Fatalf("expected n2 to report %s, got %s", nodes[2].Locality, locality)
+	}
+}
+
+func TestNodeSpecs(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+		DefaultNode: cluster.NodeSpec{
+			Flags: []string{"--cache=64MiB", "--max-sql-memory=128MiB"},
+			Store: "type=mem,size=1GiB",
+		},
+		Nodes: map[cluster.NodeID]cluster.NodeSpec{
+			// One underpowered node.
+			2: {
+				Resources: cluster.Resources{
+					CPUs:   0.5,
+					Memory: 512 << 20,
+				},
+			},
+		},
+	})
+
+	ctx := context.Background()
+	db, err := ct.Cluster().GetConnectionTo(ctx, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE specs"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResourceSqueeze(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	if err := c.UpdateResources(ctx, 1, cluster.Resources{CPUs: 0.1}); err != nil {
+		t.Fatal(err)
+	}
+	db, err := c.GetConnectionTo(ctx, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE squeezed"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.RestoreResources(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := c.Nodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, node := range nodes {
+		if node.OOMKilled {
+			t.Errorf("expected %s not to be OOM killed", node.Name)
+		}
+	}
+}
+
+func TestRollingUpgrade(t *testing.T) {
+	ct := testutils.NewClusterTest(t, testutils.ClusterTestConfig{
+		Settings: cluster.Settings{
+			Size: 3,
+		},
+		Config: &cluster.DockerConfig{
+			NetworkName: "roachnet",
+			NamePrefix:  "roach",
+			Image:       "cockroachdb/cockroach",
+			Tag:         "v19.1.5",
+		},
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	if err := c.PreserveDowngrade(ctx, "19.1"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		id := cluster.NodeID(i)
+		if err := c.UpgradeNode(ctx, id, "", "v19.2.2"); err != nil {
+			t.Fatal(err)
+		}
+		info, err := c.BuildInfo(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info["Tag"] != "v19.2.2" {
+			t.Fatalf("expected %s to run v19.2.2, got %s", id, info["Tag"])
+		}
+	}
+	version, err := c.ClusterVersion(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "19.1" {
+		t.Fatalf("expected the upgrade not to be finalized, got version %s", version)
+	}
+
+	if err := c.FinalizeUpgrade(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 1,
+	})
+
+	ctx := context.Background()
+	db, err := ct.Cluster().GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE single"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	script, err := ioutil.TempFile("", "bootstrap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(script.Name())
+	if _, err := script.WriteString(`
+CREATE DATABASE bootstrapped;
+CREATE TABLE bootstrapped.t (id INT PRIMARY KEY);
+`); err != nil {
+		t.Fatal(err)
+	}
+	script.Close()
+
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+		ClusterSettings: map[string]string{
+			"kv.range_merge.queue_enabled": "false",
+		},
+		DefaultZone: map[string]string{
+			"gc.ttlseconds": "600",
+		},
+		BootstrapSQL: []string{script.Name()},
+	})
+
+	ctx := context.Background()
+	db, err := ct.Cluster().GetConnection(ctx, "bootstrapped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled bool
+	if err := db.QueryRowContext(ctx, "SHOW CLUSTER SETTING kv.range_merge.queue_enabled").Scan(&enabled); err != nil {
+		t.Fatal(err)
+	}
+	if enabled {
+		t.Fatal("expected kv.range_merge.queue_enabled to be false")
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO t VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateRollback(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping a cluster test in short mode")
+	}
+	ctx := context.Background()
+	c, err := client.NewEnvClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Other tests of this process may have left resources, so only new
+	// ones count.
+	before := countOwnResources(ctx, t, c)
+	_, err = cluster.NewDockerCluster(ctx, c, cluster.Settings{
+		Size:           3,
+		SetupToxiproxy: true,
+		Nodes: map[cluster.NodeID]cluster.NodeSpec{
+			// Docker refuses memory limits under 4MB, so creating the
+			// last node fails after everything else was created.
+			2: {Resources: cluster.Resources{Memory: 1 << 20}},
+		},
+	}, cluster.DockerConfig{
+		NetworkName: "roachnet",
+		NamePrefix:  "roach",
+		Image:       "cockroachdb/cockroach",
+		Tag:         "latest",
+	})
+	if err == nil {
+		t.Fatal("expected creating the cluster to fail")
+	}
+	if after := countOwnResources(ctx, t, c); after != before {
+		t.Fatalf("expected the rollback to remove everything, %d resources are left", after-before)
+	}
+}
+
+// countOwnResources counts the containers, networks and volumes labeled
+// as created by this process.
+func countOwnResources(ctx context.Context, t *testing.T, c *client.Client) int {
+	args := filters.NewArgs()
+	args.Add("label", fmt.Sprintf("roachnest.pid=%d", os.Getpid()))
+	containers, err := c.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	networks, err := c.NetworkList(ctx, types.NetworkListOptions{Filters: args})
+	if err != nil {
+		t.Fatal(err)
+	}
+	volumes, err := c.VolumeList(ctx, args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(containers) + len(networks) + len(volumes.Volumes)
+}
+
+func TestParallelClusters(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		t.Run(fmt.Sprintf("cluster%d", i), func(t *testing.T) {
+			t.Parallel()
+			// Both clusters use the same names, which are namespaced.
+			ct := testutils.NewTestCluster(t, cluster.Settings{
+				Size:           3,
+				SetupToxiproxy: true,
+			})
+
+			ctx := context.Background()
+			db, err := ct.Cluster().GetConnection(ctx, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.ExecContext(ctx, "CREATE DATABASE parallel"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestAttach(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size:           3,
+		SetupToxiproxy: true,
+	})
+
+	ctx := context.Background()
+	if err := ct.Cluster().Partition(ctx, []cluster.NodeID{0, 1}, []cluster.NodeID{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Attach as another process would, and heal the partition from there.
+	c, err := client.NewEnvClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := ct.Cluster().(*cluster.DockerCluster).Name()
+	names, err := cluster.List(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, n := range names {
+		found = found || n == name
+	}
+	if !found {
+		t.Fatalf("expected cluster %q in %v", name, names)
+	}
+	attached, err := cluster.Attach(ctx, c, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := attached.Nodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 3 || nodes[2].Status != host.Running {
+		t.Fatalf("expected 3 running nodes, got %+v", nodes)
+	}
+	if err := attached.Heal(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := attached.WaitUntil(ctx, host.Running); err != nil {
+		t.Fatal(err)
+	}
+	db, err := attached.GetConnectionTo(ctx, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.ExecContext(ctx, "CREATE DATABASE attached"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterleave(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+	})
+
+	ct.LoadSchema(testutils.SchemaConfig{
+		SchemaCreator: func(db *sql.DB, gen *testutils.NameGenerator) error {
+			_, err := db.Exec("CREATE TABLE kv (k INT PRIMARY KEY, v INT); INSERT INTO kv VALUES (1, 0)")
+			return err
+		},
+	})
+
+	// A read of a row blocks on the write of an open transaction, on
+	// another gateway, and sees it once it commits.
+	il := ct.Interleave(testutils.InterleaveConfig{
+		Sessions: []testutils.Session{
+			{Name: "s1", Node: 0},
+			{Name: "s2", Node: 1},
+		},
+		Steps: []testutils.Step{
+			{Session: "s1", SQL: "BEGIN"},
+			{Session: "s1", SQL: "UPDATE kv SET v = 1 WHERE k = 1"},
+			{Session: "s2", SQL: "SELECT v FROM kv WHERE k = 1", ExpectBlocked: true, ExpectRows: [][]string{{"1"}}},
+			{Session: "s1", SQL: "COMMIT"},
+		},
+	})
+	t.Logf("interleaving:\n%s", il)
+}
@@ -3,10 +3,15 @@ package testutils
 import (
 	"context"
 	"database/sql"
+	"flag"
 	"fmt"
+	"log"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/host"
 	"github.com/moby/moby/client"
 )
 
@@ -18,7 +23,8 @@ type ClusterTest struct {
 	c   cluster.Cluster
 	gen *NameGenerator
 
-	database string
+	database  string
+	cleanedUp bool
 }
 
 type ClusterTestConfig struct {
@@ -53,46 +59,119 @@ type SchemaConfig struct {
 	SchemaCreator SchemaCreatorFunc
 }
 
+// keep leaves the clusters of tests running after the tests, so that
+// they can be looked at by hand. Clusters of failed tests are always
+// left running.
+var keep = flag.Bool("roachnest.keep", os.Getenv(keepEnv) != "", "leave the clusters of tests running, also set by "+keepEnv)
+
+const keepEnv = "ROACHNEST_KEEP"
+
+// NewClusterTest creates and starts a cluster for the test. The cluster
+// is cleaned up when the test and its subtests complete, unless the test
+// failed or -roachnest.keep is set.
 func NewClusterTest(t *testing.T, config ClusterTestConfig) *ClusterTest {
+	// Clusters need Docker, which unit tests run with -short do not.
+	if testing.Short() {
+		t.Skip("skipping a cluster test in short mode")
+	}
 	ctx := context.Background()
-	var c cluster.Cluster
+	ct := &ClusterTest{t: t, ctx: ctx, gen: NewNameGenerator()}
 	switch v := config.Config.(type) {
 	case *cluster.DockerConfig:
 		client, err := client.NewEnvClient()
 		if err != nil {
 			t.Fatal(err)
 		}
-		c, err = cluster.NewDockerCluster(ctx, client, config.Settings, *v)
+		dockerConfig := *v
+		// Kept clusters must not be reaped once the test is gone.
+		dockerConfig.Detached = dockerConfig.Detached || *keep
+		ct.c, err = cluster.NewDockerCluster(ctx, client, config.Settings, dockerConfig)
 		if err != nil {
-			// FIXME(joey): Clean is called inside the function. It should
-			// maybe be moved out.
-			//
-			// if err := c.Cleanup(ctx); err != nil {
-			// 	t.Error(err)
-			// }
+			// A cluster that fails to be created removes itself.
 			t.Fatal(err)
 		}
-		if err := c.Start(ctx); err != nil {
-			if err := c.Cleanup(ctx); err != nil {
-				t.Error(err)
-			}
-			t.Fatal(err)
+	default:
+		t.Fatalf("unsupported cluster config %T", config.Config)
+	}
+	t.Cleanup(func() {
+		if err := ct.Cleanup(); err != nil {
+			t.Error(err)
 		}
+	})
+	if err := ct.c.Start(ctx); err != nil {
+		t.Fatal(err)
 	}
+	return ct
+}
 
-	gen := NewNameGenerator()
-	return &ClusterTest{t: t, c: c, ctx: ctx, gen: gen}
+// NewTestCluster creates and starts a Docker cluster of the settings for
+// the test, running the latest cockroach image, see NewClusterTest.
+func NewTestCluster(t *testing.T, settings cluster.Settings) *ClusterTest {
+	return NewClusterTest(t, ClusterTestConfig{
+		Settings: settings,
+		Config: &cluster.DockerConfig{
+			NetworkName: "roachnet",
+			NamePrefix:  "roach",
+			Image:       "cockroachdb/cockroach",
+			Tag:         "latest",
+		},
+	})
 }
 
+// Cleanup removes the cluster, or leaves it running and logs how to
+// reach it if the test failed or -roachnest.keep is set. Only the first
+// call does anything, so it can be deferred as well.
 func (ct *ClusterTest) Cleanup() error {
+	if ct.cleanedUp {
+		return nil
+	}
+	ct.cleanedUp = true
+	if ct.t.Failed() || *keep {
+		ct.logKept()
+		return nil
+	}
 	return ct.c.Cleanup(ct.ctx)
 }
 
+// logKept logs how to connect to the cluster, and how to remove it.
+func (ct *ClusterTest) logKept() {
+	var b strings.Builder
+	fmt.Fprintf(&b, "leaving the cluster of %s running", ct.t.Name())
+	nodes, err := ct.c.Nodes(ct.ctx)
+	if err != nil {
+		fmt.Fprintf(&b, "\n  cannot list nodes: %v", err)
+	}
+	for _, info := range nodes {
+		if info.Status != host.Running {
+			fmt.Fprintf(&b, "\n  %s: %s", info.ID, info.Status)
+			continue
+		}
+		dsn, err := ct.c.DSN(cluster.ConnOptions{Node: info.ID})
+		if err != nil {
+			dsn = err.Error()
+		}
+		fmt.Fprintf(&b, "\n  %s: %s admin UI %s", info.ID, dsn, ct.c.Node(info.ID).AdminURL())
+	}
+	if named, ok := ct.c.(interface{ Name() string }); ok {
+		fmt.Fprintf(&b, "\nremove it with: go run ./pkg/cmd down -cluster %s", named.Name())
+		if !*keep {
+			fmt.Fprintf(&b, "\nor with the other clusters of gone tests: go run ./pkg/cmd reap")
+		}
+	}
+	log.Print(b.String())
+}
+
+// Cluster returns the cluster under test, e.g. to stop or restart its
+// nodes.
+func (ct *ClusterTest) Cluster() cluster.Cluster {
+	return ct.c
+}
+
 func (ct *ClusterTest) LoadData(config DataConfig) error {
 	if config.Typ != Generator && config.RowGenerator != nil {
-		ct.t.Fatal("bad DataConfig.  RowGenerator was set but type is not Generator. got type: %s", config.Typ)
+		ct.t.Fatalf("bad DataConfig. RowGenerator was set but type is not Generator. got type: %d", config.Typ)
 	} else if config.Typ != File && config.Source != "" {
-		ct.t.Fatal("bad DataConfig. Source was set but not type is not File. got type: %s", config.Typ)
+		ct.t.Fatalf("bad DataConfig. Source was set but type is not File. got type: %d", config.Typ)
 	}
 
 	// FIXME(joey): We should require LoadSchema by here, or initialize
@@ -124,22 +203,21 @@ func (ct *ClusterTest) LoadSchema(config SchemaConfig) error {
 		ct.database = ct.gen.DatabaseName()
 	}
 
-	conn, err := ct.c.GetConnection(ct.ctx, ct.database)
+	// The database has to exist before connecting to it.
+	root, err := ct.c.GetConnection(ct.ctx, "")
 	if err != nil {
 		ct.t.Fatal(err)
 	}
-
-	if _, err := conn.ExecContext(ct.ctx,
+	if _, err := root.ExecContext(ct.ctx,
 		fmt.Sprintf("CREATE DATABASE %q", ct.database),
 	); err != nil {
 		ct.t.Fatal(err)
 	}
-	// if _, err := conn.ExecContext(ct.ctx,
-	// 	fmt.Sprintf("USE %q", ct.database),
-	// ); err != nil {
-	// 	ct.t.Fatal(err)
-	// }
 
+	conn, err := ct.c.GetConnection(ct.ctx, ct.database)
+	if err != nil {
+		ct.t.Fatal(err)
+	}
 	if err := config.SchemaCreator(conn, ct.gen); err != nil {
 		ct.t.Fatal(err)
 	}
@@ -0,0 +1,347 @@
+package testutils
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lib/pq"
+)
+
+// Session is a SQL session of an interleaving, with a connection of its
+// own through the Node gateway.
+type Session struct {
+	Name string
+	Node cluster.NodeID
+}
+
+// Step is a statement run by a session of an interleaving, and what it
+// is expected to do.
+type Step struct {
+	Session string
+	SQL     string
+	Args    []interface{}
+
+	// ExpectBlocked expects the statement not to complete within the
+	// BlockTimeout, e.g. as it waits on a lock of another session.
+	ExpectBlocked bool
+	// Expect is the expected outcome of the statement, StepOK by default.
+	Expect StepOutcome
+	// ExpectRows are the expected rows of the statement, as strings, with
+	// NULL for NULL values. Nil rows are not checked.
+	ExpectRows [][]string
+}
+
+// StepOutcome is how a step of an interleaving ended.
+type StepOutcome int
+
+const (
+	// StepOK is a statement that succeeded.
+	StepOK StepOutcome = iota
+	// StepRetry is a statement that failed with a retry error, 40001.
+	// CockroachDB also breaks deadlocks with retry errors.
+	StepRetry
+	// StepDeadlock is a statement that failed as a deadlock, 40P01, or
+	// that was still blocked after the Timeout while a statement of
+	// another session was too.
+	StepDeadlock
+	// StepError is a statement that failed with any other error.
+	StepError
+	// StepStuck is a statement that was still blocked after the Timeout,
+	// while no other statement was.
+	StepStuck
+	// StepSkipped is a statement that was not run, as the interleaving
+	// got stuck before it.
+	StepSkipped
+)
+
+func (o StepOutcome) String() string {
+	switch o {
+	case StepOK:
+		return "ok"
+	case StepRetry:
+		return "retry"
+	case StepDeadlock:
+		return "deadlock"
+	case StepError:
+		return "error"
+	case StepStuck:
+		return "stuck"
+	case StepSkipped:
+		return "skipped"
+	}
+	return fmt.Sprintf("StepOutcome(%d)", int(o))
+}
+
+// StepResult is what a step of an interleaving did.
+type StepResult struct {
+	Step    Step
+	Blocked bool
+	Outcome StepOutcome
+	Rows    [][]string
+	Err     error
+}
+
+// Interleaving is the results of the steps of an interleaving, in
+// order.
+type Interleaving []StepResult
+
+// String formats the interleaving as a table.
+func (il Interleaving) String() string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STEP\tSESSION\tSQL\tBLOCKED\tOUTCOME\tRESULT")
+	for i, r := range il {
+		result := formatRows(r.Rows)
+		if r.Err != nil {
+			result = r.Err.Error()
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%s\t%s\n", i, r.Step.Session, r.Step.SQL, r.Blocked, r.Outcome, result)
+	}
+	w.Flush()
+	return b.String()
+}
+
+type InterleaveConfig struct {
+	// Database defaults to the database of LoadSchema.
+	Database string
+	Sessions []Session
+	Steps    []Step
+
+	// BlockTimeout is how long a statement may run before it is
+	// considered blocked. It defaults to 1s.
+	BlockTimeout time.Duration
+	// Timeout is how long a blocked statement is waited for, before a
+	// later statement of its session or at the end. It defaults to 10s.
+	Timeout time.Duration
+}
+
+// stepDone is a statement that completed.
+type stepDone struct {
+	index int
+	rows  [][]string
+	err   error
+}
+
+// Interleave runs the steps in order, each on the connection of its
+// session. A step that does not complete within the BlockTimeout is
+// blocked, and the next steps run while it waits; a later step of the
+// same session waits for it first. The test fails if a step does not do
+// what it is expected to, and the interleaving is logged.
+//
+// The sessions are closed at the end, which rolls back their open
+// transactions.
+func (ct *ClusterTest) Interleave(config InterleaveConfig) Interleaving {
+	ct.t.Helper()
+	if config.Database == "" {
+		config.Database = ct.database
+	}
+	if config.BlockTimeout == 0 {
+		config.BlockTimeout = time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+
+	// Every session gets a connection of its own, rather than one shared
+	// by Connect, so that it is the only user of its transaction.
+	dbs := make(map[string]*sql.DB, len(config.Sessions))
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+	for _, s := range config.Sessions {
+		if _, ok := dbs[s.Name]; ok {
+			ct.t.Fatalf("duplicate session %q", s.Name)
+		}
+		dsn, err := ct.c.DSN(cluster.ConnOptions{
+			Node:            s.Node,
+			Database:        config.Database,
+			ApplicationName: "interleave_" + s.Name,
+		})
+		if err != nil {
+			ct.t.Fatal(err)
+		}
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			ct.t.Fatal(err)
+		}
+		db.SetMaxOpenConns(1)
+		db.SetMaxIdleConns(1)
+		dbs[s.Name] = db
+		if err := db.PingContext(ct.ctx); err != nil {
+			ct.t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ct.ctx)
+	defer cancel()
+	results := make(Interleaving, len(config.Steps))
+	for i, step := range config.Steps {
+		if _, ok := dbs[step.Session]; !ok {
+			ct.t.Fatalf("step %d: unknown session %q", i, step.Session)
+		}
+		results[i] = StepResult{Step: step, Outcome: StepSkipped}
+	}
+
+	// pending is the index of the running statement of each session.
+	// Statements send on done, which is buffered so that those that
+	// never complete do not leak.
+	pending := make(map[string]int)
+	done := make(chan stepDone, len(config.Steps))
+	finish := func(d stepDone) {
+		r := &results[d.index]
+		r.Rows, r.Err = d.rows, d.err
+		r.Outcome = outcome(d.err)
+		delete(pending, r.Step.Session)
+	}
+	// waitFor waits for the running statement of the session, finishing
+	// any other that completes meanwhile. It returns false on timeout.
+	waitFor := func(session string, timeout time.Duration) bool {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			if _, ok := pending[session]; !ok {
+				return true
+			}
+			select {
+			case d := <-done:
+				finish(d)
+			case <-timer.C:
+				return false
+			}
+		}
+	}
+
+	stuck := false
+	for i, step := range config.Steps {
+		if !waitFor(step.Session, config.Timeout) {
+			stuck = true
+			break
+		}
+		pending[step.Session] = i
+		go func(i int, db *sql.DB, step Step) {
+			rows, err := query(ctx, db, step.SQL, step.Args...)
+			done <- stepDone{index: i, rows: rows, err: err}
+		}(i, dbs[step.Session], step)
+		if !waitFor(step.Session, config.BlockTimeout) {
+			results[i].Blocked = true
+		}
+	}
+	if !stuck {
+		timer := time.NewTimer(config.Timeout)
+	wait:
+		for len(pending) > 0 {
+			select {
+			case d := <-done:
+				finish(d)
+			case <-timer.C:
+				break wait
+			}
+		}
+		timer.Stop()
+	}
+	// Statements still blocked wait on each other, or on something
+	// outside of the interleaving.
+	still := StepStuck
+	if len(pending) > 1 {
+		still = StepDeadlock
+	}
+	for _, i := range pending {
+		results[i].Outcome = still
+		results[i].Err = fmt.Errorf("still blocked after %s", config.Timeout)
+	}
+
+	ok := true
+	for i, r := range results {
+		if msg := r.mismatch(); msg != "" {
+			ct.t.Errorf("step %d (%s: %s): %s", i, r.Step.Session, r.Step.SQL, msg)
+			ok = false
+		}
+	}
+	if !ok {
+		ct.t.Logf("interleaving:\n%s", results)
+	}
+	return results
+}
+
+// mismatch describes how the step did not do what it was expected to,
+// or is empty.
+func (r StepResult) mismatch() string {
+	var problems []string
+	if r.Blocked != r.Step.ExpectBlocked {
+		problems = append(problems, fmt.Sprintf("blocked is %t, expected %t", r.Blocked, r.Step.ExpectBlocked))
+	}
+	if r.Outcome != r.Step.Expect {
+		problem := fmt.Sprintf("outcome is %s, expected %s", r.Outcome, r.Step.Expect)
+		if r.Err != nil {
+			problem += fmt.Sprintf(" (%v)", r.Err)
+		}
+		problems = append(problems, problem)
+	} else if r.Step.ExpectRows != nil && formatRows(r.Rows) != formatRows(r.Step.ExpectRows) {
+		problems = append(problems, fmt.Sprintf("rows are %s, expected %s", formatRows(r.Rows), formatRows(r.Step.ExpectRows)))
+	}
+	return strings.Join(problems, ", ")
+}
+
+func outcome(err error) StepOutcome {
+	if err == nil {
+		return StepOK
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "40001":
+			return StepRetry
+		case "40P01":
+			return StepDeadlock
+		}
+	}
+	return StepError
+}
+
+// query runs a statement and returns its rows as strings.
+func query(ctx context.Context, db *sql.DB, stmt string, args ...interface{}) ([][]string, error) {
+	rows, err := db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var out [][]string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		row := make([]string, len(cols))
+		for i, v := range vals {
+			row[i] = "NULL"
+			if v.Valid {
+				row[i] = v.String
+			}
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+func formatRows(rows [][]string) string {
+	parts := make([]string, len(rows))
+	for i, row := range rows {
+		parts[i] = "(" + strings.Join(row, ", ") + ")"
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
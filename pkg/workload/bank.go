@@ -0,0 +1,60 @@
+package workload
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+)
+
+// Bank transfers money between accounts, which contend with each other
+// when there are few accounts, and reads single balances.
+type Bank struct {
+	// Accounts is the number of accounts. It defaults to 100.
+	Accounts int
+}
+
+func (b Bank) accounts() int {
+	if b.Accounts == 0 {
+		return 100
+	}
+	return b.Accounts
+}
+
+func (b Bank) Setup(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx,
+		"CREATE TABLE IF NOT EXISTS accounts (id INT PRIMARY KEY, balance INT NOT NULL)",
+	); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx,
+		"UPSERT INTO accounts SELECT i, 1000 FROM generate_series(0, $1) AS g(i)", b.accounts()-1,
+	)
+	return err
+}
+
+func (b Bank) Next(rng *rand.Rand) Op {
+	n := b.accounts()
+	if rng.Intn(10) == 0 {
+		id := rng.Intn(n)
+		return Op{Name: "balance", Run: func(ctx context.Context, db *sql.DB) error {
+			var balance int64
+			return db.QueryRowContext(ctx, "SELECT balance FROM accounts WHERE id = $1", id).Scan(&balance)
+		}}
+	}
+	from := rng.Intn(n)
+	to := (from + 1 + rng.Intn(n-1)) % n
+	amount := 1 + rng.Intn(10)
+	return Op{Name: "transfer", Run: func(ctx context.Context, db *sql.DB) error {
+		return inTxn(ctx, db, func(tx *sql.Tx) error {
+			if _, err := tx.ExecContext(ctx,
+				"UPDATE accounts SET balance = balance - $1 WHERE id = $2", amount, from,
+			); err != nil {
+				return err
+			}
+			_, err := tx.ExecContext(ctx,
+				"UPDATE accounts SET balance = balance + $1 WHERE id = $2", amount, to,
+			)
+			return err
+		})
+	}}
+}
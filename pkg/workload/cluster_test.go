@@ -0,0 +1,80 @@
+package workload
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/lego/roachnest/pkg/cluster"
+	"github.com/lego/roachnest/pkg/testutils"
+)
+
+func TestWorkloadUnderFaults(t *testing.T) {
+	ct := testutils.NewTestCluster(t, cluster.Settings{
+		Size: 3,
+	})
+
+	ctx := context.Background()
+	c := ct.Cluster()
+	root, err := c.GetConnection(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := root.ExecContext(ctx, "CREATE DATABASE load"); err != nil {
+		t.Fatal(err)
+	}
+	// Node 2 is killed, so the load goes through the others.
+	var dbs []*sql.DB
+	for id := cluster.NodeID(0); id < 2; id++ {
+		db, err := c.GetConnectionTo(ctx, id, "load")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs = append(dbs, db)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		workload Workload
+	}{
+		{"kv", KV{ReadPercent: 50}},
+		{"bank", Bank{}},
+		{"tpcc", TPCC{}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.workload.Setup(ctx, dbs[0]); err != nil {
+				t.Fatal(err)
+			}
+			killed := make(chan time.Time, 1)
+			go func() {
+				time.Sleep(10 * time.Second)
+				killed <- time.Now()
+				if err := c.KillNode(ctx, 2); err != nil {
+					t.Error(err)
+				}
+			}()
+			stats, err := Run(ctx, tc.workload, Config{
+				DBs:      dbs,
+				Rate:     50,
+				Duration: 20 * time.Second,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("stats:\n%s", stats)
+			if err := c.RestartNode(ctx, 2); err != nil {
+				t.Fatal(err)
+			}
+			// The load through the other nodes is fast until the kill.
+			if err := stats.Check(SLO{
+				To:        <-killed,
+				Quantile:  0.99,
+				Latency:   500 * time.Millisecond,
+				ErrorRate: 0.001,
+			}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
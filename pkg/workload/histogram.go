@@ -0,0 +1,142 @@
+package workload
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// subBucketBits is the precision of a Histogram: values are counted in
+// buckets of 2^(subBucketBits-1) linear sub-buckets per power of two,
+// for a relative error under 1/64.
+const subBucketBits = 7
+
+const (
+	subBuckets     = 1 << subBucketBits
+	halfSubBuckets = subBuckets / 2
+)
+
+// Histogram is a histogram of latencies in the style of HdrHistogram:
+// the buckets are exact below 128ns, and then have a constant relative
+// width, so that any quantile is known to within 2%. The zero value is
+// empty and ready to use. It is not safe for concurrent use.
+type Histogram struct {
+	counts   []int64
+	count    int64
+	sum      int64
+	min, max int64
+}
+
+// bucket returns the index of the bucket of v.
+func bucket(v int64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	// Keep the top subBucketBits bits of v.
+	shift := uint(bits.Len64(uint64(v)) - subBucketBits)
+	return subBuckets + int(shift-1)*halfSubBuckets + int(v>>shift) - halfSubBuckets
+}
+
+// bucketValue returns the highest value of the bucket.
+func bucketValue(i int) int64 {
+	if i < subBuckets {
+		return int64(i)
+	}
+	i -= subBuckets
+	shift := uint(i/halfSubBuckets + 1)
+	sub := int64(i%halfSubBuckets + halfSubBuckets)
+	return (sub+1)<<shift - 1
+}
+
+// Record adds a latency to the histogram. Negative latencies count as
+// zero.
+func (h *Histogram) Record(d time.Duration) {
+	v := int64(d)
+	if v < 0 {
+		v = 0
+	}
+	i := bucket(v)
+	if i >= len(h.counts) {
+		counts := make([]int64, i+1)
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	h.counts[i]++
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+}
+
+// Merge adds the latencies of o to the histogram.
+func (h *Histogram) Merge(o *Histogram) {
+	if o.count == 0 {
+		return
+	}
+	if len(o.counts) > len(h.counts) {
+		counts := make([]int64, len(o.counts))
+		copy(counts, h.counts)
+		h.counts = counts
+	}
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || o.min < h.min {
+		h.min = o.min
+	}
+	if o.max > h.max {
+		h.max = o.max
+	}
+	h.count += o.count
+	h.sum += o.sum
+}
+
+// Count is the number of latencies recorded.
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+// Min and Max are the lowest and highest latencies recorded, exactly.
+func (h *Histogram) Min() time.Duration {
+	return time.Duration(h.min)
+}
+
+func (h *Histogram) Max() time.Duration {
+	return time.Duration(h.max)
+}
+
+// Mean is the mean of the latencies recorded.
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return time.Duration(h.sum / h.count)
+}
+
+// Quantile returns the latency that q of the latencies recorded are at
+// or under, e.g. 0.99 for the p99. It is zero for an empty histogram.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			v := bucketValue(i)
+			if v > h.max {
+				v = h.max
+			}
+			return time.Duration(v)
+		}
+	}
+	return time.Duration(h.max)
+}
@@ -0,0 +1,54 @@
+package workload
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+)
+
+// KV reads and writes single rows of a key-value table.
+type KV struct {
+	// Keys is the number of keys. It defaults to 1000.
+	Keys int
+	// ReadPercent is the percentage of operations that are reads, and
+	// the others are writes. Zero is writes only.
+	ReadPercent int
+	// ValueBytes is the size of the values written. It defaults to 64.
+	ValueBytes int
+}
+
+func (kv KV) keys() int {
+	if kv.Keys == 0 {
+		return 1000
+	}
+	return kv.Keys
+}
+
+func (kv KV) Setup(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS kv (k INT PRIMARY KEY, v BYTES NOT NULL)")
+	return err
+}
+
+func (kv KV) Next(rng *rand.Rand) Op {
+	k := rng.Intn(kv.keys())
+	if rng.Intn(100) < kv.ReadPercent {
+		return Op{Name: "read", Run: func(ctx context.Context, db *sql.DB) error {
+			var v []byte
+			err := db.QueryRowContext(ctx, "SELECT v FROM kv WHERE k = $1", k).Scan(&v)
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		}}
+	}
+	size := kv.ValueBytes
+	if size == 0 {
+		size = 64
+	}
+	v := make([]byte, size)
+	rng.Read(v)
+	return Op{Name: "write", Run: func(ctx context.Context, db *sql.DB) error {
+		_, err := db.ExecContext(ctx, "UPSERT INTO kv (k, v) VALUES ($1, $2)", k, v)
+		return err
+	}}
+}
@@ -0,0 +1,212 @@
+// Package workload drives sustained load against a cluster, e.g. while
+// faults are injected, and measures the latency of every type of
+// operation.
+package workload
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Workload generates the operations of a load.
+type Workload interface {
+	// Setup creates and fills the tables of the workload.
+	Setup(ctx context.Context, db *sql.DB) error
+	// Next returns the next operation to run, drawing any choice from
+	// rng. It is called by one worker at a time.
+	Next(rng *rand.Rand) Op
+}
+
+// Op is an operation of a workload. Name is its type, which its latency
+// is recorded under.
+type Op struct {
+	Name string
+	Run  func(ctx context.Context, db *sql.DB) error
+}
+
+// Config configures Run.
+type Config struct {
+	// DBs are the connections of the operations, e.g. one per gateway
+	// node. Worker i, or the i-th operation of an open loop, uses
+	// DBs[i%len(DBs)].
+	DBs []*sql.DB
+	// Concurrency is the number of workers of a closed loop. It defaults
+	// to 8, and does not apply to an open loop.
+	Concurrency int
+	// Rate is the number of operations to start per second. Each one
+	// starts on schedule in a goroutine of its own, whether or not
+	// earlier ones completed, and its latency is measured from when it
+	// was meant to start, so that a stalled cluster shows up as latency
+	// and errors rather than as fewer operations. Zero runs Concurrency
+	// workers in a closed loop, as fast as they go.
+	Rate float64
+	// MaxInFlight bounds the operations of an open loop that run at
+	// once. Operations due while it is reached are not started, and
+	// count as errors. It defaults to 1000.
+	MaxInFlight int
+	// Duration is how long to run. Zero runs until ctx is done.
+	Duration time.Duration
+	// OpTimeout bounds every operation. It defaults to 10s.
+	OpTimeout time.Duration
+	// Interval is the resolution of the windows of the Stats. It defaults
+	// to 1s.
+	Interval time.Duration
+	// Seed is the seed of the operations that are generated.
+	Seed int64
+}
+
+const (
+	defaultConcurrency = 8
+	defaultMaxInFlight = 1000
+	defaultOpTimeout   = 10 * time.Second
+	defaultInterval    = time.Second
+)
+
+var (
+	// errMaxInFlight is the error of the operations of an open loop that
+	// were not started, as MaxInFlight operations were running.
+	errMaxInFlight = errors.New("too many operations in flight")
+	// errUnfinished is the error of the operations that were still
+	// running when the run ended.
+	errUnfinished = errors.New("operation unfinished at the end of the run")
+)
+
+// Run runs the workload until ctx is done or the Duration passed, and
+// returns the statistics of its operations. Operations cut short by the
+// end of the run count as errors, as they did not complete in time.
+func Run(ctx context.Context, w Workload, config Config) (*Stats, error) {
+	if len(config.DBs) == 0 {
+		return nil, errors.New("Config has no DBs")
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = defaultConcurrency
+	}
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = defaultMaxInFlight
+	}
+	if config.OpTimeout == 0 {
+		config.OpTimeout = defaultOpTimeout
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultInterval
+	}
+	if config.Duration != 0 {
+		var cancel func()
+		ctx, cancel = context.WithTimeout(ctx, config.Duration)
+		defer cancel()
+	}
+
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(config.Seed))
+	next := func() Op {
+		mu.Lock()
+		defer mu.Unlock()
+		return w.Next(rng)
+	}
+
+	start := time.Now()
+	stats := newStats(start, config.Interval)
+	// run runs an operation that was due at the time, and records it.
+	run := func(op Op, db *sql.DB, due time.Time) {
+		opCtx, cancel := context.WithTimeout(ctx, config.OpTimeout)
+		err := op.Run(opCtx, db)
+		cancel()
+		if err != nil && ctx.Err() != nil {
+			err = errUnfinished
+		}
+		stats.record(op.Name, due, time.Since(due), err)
+	}
+
+	var wg sync.WaitGroup
+	if config.Rate > 0 {
+		period := time.Duration(float64(time.Second) / config.Rate)
+		// inFlight holds a token for every operation that runs.
+		inFlight := make(chan struct{}, config.MaxInFlight)
+		due := start
+		for i := 0; sleepUntil(ctx, due); i++ {
+			op := next()
+			select {
+			case inFlight <- struct{}{}:
+			default:
+				stats.record(op.Name, due, 0, errMaxInFlight)
+				due = due.Add(period)
+				continue
+			}
+			wg.Add(1)
+			go func(op Op, db *sql.DB, due time.Time) {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				run(op, db, due)
+			}(op, config.DBs[i%len(config.DBs)], due)
+			due = due.Add(period)
+		}
+		wg.Wait()
+		return stats, nil
+	}
+
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func(db *sql.DB) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				run(next(), db, time.Now())
+			}
+		}(config.DBs[i%len(config.DBs)])
+	}
+	wg.Wait()
+	return stats, nil
+}
+
+// sleepUntil waits for the time, and reports false if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// maxRetries bounds the retries of a transaction.
+const maxRetries = 10
+
+// inTxn runs fn in a transaction and commits it, retrying the whole
+// transaction on retry errors, as clients of CockroachDB must.
+func inTxn(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		if err = tryTxn(ctx, db, fn); !retryable(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func tryTxn(ctx context.Context, db *sql.DB, fn func(*sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func retryable(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "40001"
+}
@@ -0,0 +1,183 @@
+package workload
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// OpStats are the latencies of the operations of a type that succeeded,
+// and the number that failed.
+type OpStats struct {
+	Latency Histogram
+	Errors  int64
+}
+
+// ErrorRate is the fraction of the operations that failed.
+func (o *OpStats) ErrorRate() float64 {
+	total := o.Latency.Count() + o.Errors
+	if total == 0 {
+		return 0
+	}
+	return float64(o.Errors) / float64(total)
+}
+
+func (o *OpStats) merge(other *OpStats) {
+	o.Latency.Merge(&other.Latency)
+	o.Errors += other.Errors
+}
+
+// Stats are the statistics of a run, per type of operation, kept per
+// interval so that they can be looked at over a window of the run, e.g.
+// while a fault was injected.
+type Stats struct {
+	start    time.Time
+	interval time.Duration
+
+	mu        sync.Mutex
+	intervals []map[string]*OpStats
+}
+
+func newStats(start time.Time, interval time.Duration) *Stats {
+	return &Stats{start: start, interval: interval}
+}
+
+// record adds an operation that was meant to start at the time.
+func (s *Stats) record(op string, at time.Time, latency time.Duration, err error) {
+	i := 0
+	if at.After(s.start) {
+		i = int(at.Sub(s.start) / s.interval)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.intervals) <= i {
+		s.intervals = append(s.intervals, make(map[string]*OpStats))
+	}
+	stats, ok := s.intervals[i][op]
+	if !ok {
+		stats = &OpStats{}
+		s.intervals[i][op] = stats
+	}
+	if err != nil {
+		stats.Errors++
+		return
+	}
+	stats.Latency.Record(latency)
+}
+
+// Start is when the run started.
+func (s *Stats) Start() time.Time {
+	return s.start
+}
+
+// Window returns the statistics of the operations meant to start between
+// from and to, per type. Zero times leave the window open. The window is
+// rounded out to the intervals of the run.
+func (s *Stats) Window(from, to time.Time) map[string]*OpStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]*OpStats)
+	for i, ops := range s.intervals {
+		start := s.start.Add(time.Duration(i) * s.interval)
+		if (!from.IsZero() && !start.Add(s.interval).After(from)) || (!to.IsZero() && !start.Before(to)) {
+			continue
+		}
+		for op, stats := range ops {
+			if _, ok := out[op]; !ok {
+				out[op] = &OpStats{}
+			}
+			out[op].merge(stats)
+		}
+	}
+	return out
+}
+
+// Total returns the statistics of the whole run, per type.
+func (s *Stats) Total() map[string]*OpStats {
+	return s.Window(time.Time{}, time.Time{})
+}
+
+// String formats the statistics of the whole run as a table.
+func (s *Stats) String() string {
+	total := s.Total()
+	ops := make([]string, 0, len(total))
+	for op := range total {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "OP\tOK\tERRORS\tP50\tP95\tP99\tMAX")
+	for _, op := range ops {
+		o := total[op]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", op, o.Latency.Count(), o.Errors,
+			o.Latency.Quantile(0.5), o.Latency.Quantile(0.95), o.Latency.Quantile(0.99), o.Latency.Max())
+	}
+	w.Flush()
+	return b.String()
+}
+
+// SLO is an objective for the operations of a window of a run, e.g. a
+// p99 under 500ms and an error rate under 0.1%.
+type SLO struct {
+	// Op is the type of operations, or empty for all of them.
+	Op string
+	// From and To are the window, see Window.
+	From, To time.Time
+
+	// Quantile of the latencies of the operations that succeeded must
+	// be under Latency, e.g. 0.99 and 500ms. A zero Latency is not
+	// checked.
+	Quantile float64
+	Latency  time.Duration
+	// ErrorRate is the fraction of operations that may fail, e.g. 0.001.
+	// Zero is not checked.
+	ErrorRate float64
+}
+
+func (slo SLO) String() string {
+	op := slo.Op
+	if op == "" {
+		op = "all ops"
+	}
+	var objectives []string
+	if slo.Latency != 0 {
+		objectives = append(objectives, fmt.Sprintf("p%g < %s", slo.Quantile*100, slo.Latency))
+	}
+	if slo.ErrorRate != 0 {
+		objectives = append(objectives, fmt.Sprintf("error rate < %g%%", slo.ErrorRate*100))
+	}
+	return op + ": " + strings.Join(objectives, ", ")
+}
+
+// Check returns an error for every SLO that the run missed.
+func (s *Stats) Check(slos ...SLO) error {
+	var missed []string
+	for _, slo := range slos {
+		var o OpStats
+		for op, stats := range s.Window(slo.From, slo.To) {
+			if slo.Op == "" || slo.Op == op {
+				o.merge(stats)
+			}
+		}
+		if slo.Latency != 0 {
+			if q := o.Latency.Quantile(slo.Quantile); q >= slo.Latency {
+				missed = append(missed, fmt.Sprintf("%s, but p%g is %s", slo, slo.Quantile*100, q))
+			}
+		}
+		if slo.ErrorRate != 0 {
+			if rate := o.ErrorRate(); rate >= slo.ErrorRate {
+				missed = append(missed, fmt.Sprintf("%s, but the error rate is %.3g%% (%d of %d)",
+					slo, rate*100, o.Errors, o.Errors+o.Latency.Count()))
+			}
+		}
+	}
+	if len(missed) > 0 {
+		return fmt.Errorf("missed %d SLOs:\n%s", len(missed), strings.Join(missed, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package workload
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+)
+
+// TPCC is a small workload in the spirit of TPC-C: orders are entered
+// and paid for in the districts of some warehouses, with the mix of
+// transactions of the benchmark but a fraction of its data, and none of
+// its rules on keying and think times.
+type TPCC struct {
+	// Warehouses is the number of warehouses, each with 10 districts. It
+	// defaults to 1.
+	Warehouses int
+	// Items is the number of items, each in stock in every warehouse. It
+	// defaults to 1000.
+	Items int
+	// Customers is the number of customers per district. It defaults to
+	// 30.
+	Customers int
+}
+
+const tpccDistricts = 10
+
+var tpccSchema = []string{
+	`CREATE TABLE IF NOT EXISTS warehouse (
+		w_id INT PRIMARY KEY,
+		w_ytd INT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS district (
+		d_w_id INT,
+		d_id INT,
+		d_ytd INT NOT NULL,
+		d_next_o_id INT NOT NULL,
+		PRIMARY KEY (d_w_id, d_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS customer (
+		c_w_id INT,
+		c_d_id INT,
+		c_id INT,
+		c_balance INT NOT NULL,
+		c_payment_cnt INT NOT NULL,
+		PRIMARY KEY (c_w_id, c_d_id, c_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS item (
+		i_id INT PRIMARY KEY,
+		i_price INT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS stock (
+		s_w_id INT,
+		s_i_id INT,
+		s_quantity INT NOT NULL,
+		PRIMARY KEY (s_w_id, s_i_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS orders (
+		o_w_id INT,
+		o_d_id INT,
+		o_id INT,
+		o_c_id INT NOT NULL,
+		o_ol_cnt INT NOT NULL,
+		o_entry_d TIMESTAMP NOT NULL,
+		PRIMARY KEY (o_w_id, o_d_id, o_id),
+		INDEX (o_w_id, o_d_id, o_c_id, o_id DESC)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_line (
+		ol_w_id INT,
+		ol_d_id INT,
+		ol_o_id INT,
+		ol_number INT,
+		ol_i_id INT NOT NULL,
+		ol_quantity INT NOT NULL,
+		ol_amount INT NOT NULL,
+		PRIMARY KEY (ol_w_id, ol_d_id, ol_o_id, ol_number)
+	)`,
+}
+
+func (t TPCC) sizes() (warehouses, items, customers int) {
+	warehouses, items, customers = t.Warehouses, t.Items, t.Customers
+	if warehouses == 0 {
+		warehouses = 1
+	}
+	if items == 0 {
+		items = 1000
+	}
+	if customers == 0 {
+		customers = 30
+	}
+	return warehouses, items, customers
+}
+
+func (t TPCC) Setup(ctx context.Context, db *sql.DB) error {
+	for _, stmt := range tpccSchema {
+		if _, err := db.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	warehouses, items, customers := t.sizes()
+	for _, load := range []struct {
+		stmt string
+		args []interface{}
+	}{
+		{"UPSERT INTO warehouse SELECT w, 0 FROM generate_series(1, $1) AS g(w)",
+			[]interface{}{warehouses}},
+		{`UPSERT INTO district SELECT w, d, 0, 1
+		  FROM generate_series(1, $1) AS g(w), generate_series(1, $2) AS h(d)`,
+			[]interface{}{warehouses, tpccDistricts}},
+		{`UPSERT INTO customer SELECT w, d, c, 0, 0
+		  FROM generate_series(1, $1) AS g(w), generate_series(1, $2) AS h(d), generate_series(1, $3) AS i(c)`,
+			[]interface{}{warehouses, tpccDistricts, customers}},
+		{"UPSERT INTO item SELECT i, 100 + i % 9900 FROM generate_series(1, $1) AS g(i)",
+			[]interface{}{items}},
+		{`UPSERT INTO stock SELECT w, i, 10 + i % 91
+		  FROM generate_series(1, $1) AS g(w), generate_series(1, $2) AS h(i)`,
+			[]interface{}{warehouses, items}},
+	} {
+		if _, err := db.ExecContext(ctx, load.stmt, load.args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderLine is an item of a new order.
+type orderLine struct {
+	item, quantity int
+}
+
+// Next picks a transaction with the mix of TPC-C, without delivery:
+// 45% new orders, 43% payments, and order status and stock level checks
+// for the rest.
+func (t TPCC) Next(rng *rand.Rand) Op {
+	warehouses, items, customers := t.sizes()
+	w := 1 + rng.Intn(warehouses)
+	d := 1 + rng.Intn(tpccDistricts)
+	c := 1 + rng.Intn(customers)
+	switch n := rng.Intn(100); {
+	case n < 45:
+		lines := make([]orderLine, 5+rng.Intn(11))
+		for i := range lines {
+			lines[i] = orderLine{item: 1 + rng.Intn(items), quantity: 1 + rng.Intn(10)}
+		}
+		return Op{Name: "new_order", Run: func(ctx context.Context, db *sql.DB) error {
+			return inTxn(ctx, db, func(tx *sql.Tx) error {
+				return newOrder(ctx, tx, w, d, c, lines)
+			})
+		}}
+	case n < 88:
+		amount := 100 + rng.Intn(500000)
+		return Op{Name: "payment", Run: func(ctx context.Context, db *sql.DB) error {
+			return inTxn(ctx, db, func(tx *sql.Tx) error {
+				return payment(ctx, tx, w, d, c, amount)
+			})
+		}}
+	case n < 94:
+		return Op{Name: "order_status", Run: func(ctx context.Context, db *sql.DB) error {
+			return inTxn(ctx, db, func(tx *sql.Tx) error {
+				return orderStatus(ctx, tx, w, d, c)
+			})
+		}}
+	default:
+		threshold := 10 + rng.Intn(11)
+		return Op{Name: "stock_level", Run: func(ctx context.Context, db *sql.DB) error {
+			var low int
+			return db.QueryRowContext(ctx,
+				`SELECT count(DISTINCT s_i_id) FROM order_line
+				 JOIN stock ON s_w_id = ol_w_id AND s_i_id = ol_i_id
+				 WHERE ol_w_id = $1 AND ol_d_id = $2 AND s_quantity < $3
+				   AND ol_o_id >= (SELECT d_next_o_id - 20 FROM district WHERE d_w_id = $1 AND d_id = $2)`,
+				w, d, threshold,
+			).Scan(&low)
+		}}
+	}
+}
+
+func newOrder(ctx context.Context, tx *sql.Tx, w, d, c int, lines []orderLine) error {
+	var o int
+	if err := tx.QueryRowContext(ctx,
+		`UPDATE district SET d_next_o_id = d_next_o_id + 1
+		 WHERE d_w_id = $1 AND d_id = $2 RETURNING d_next_o_id - 1`,
+		w, d,
+	).Scan(&o); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO orders VALUES ($1, $2, $3, $4, $5, now())", w, d, o, c, len(lines),
+	); err != nil {
+		return err
+	}
+	for i, line := range lines {
+		var price int
+		if err := tx.QueryRowContext(ctx,
+			"SELECT i_price FROM item WHERE i_id = $1", line.item,
+		).Scan(&price); err != nil {
+			return err
+		}
+		// Stock is replenished when it runs low, as in TPC-C.
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE stock SET s_quantity = CASE
+			   WHEN s_quantity >= $1 + 10 THEN s_quantity - $1
+			   ELSE s_quantity - $1 + 91 END
+			 WHERE s_w_id = $2 AND s_i_id = $3`,
+			line.quantity, w, line.item,
+		); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx,
+			"INSERT INTO order_line VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			w, d, o, i+1, line.item, line.quantity, price*line.quantity,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func payment(ctx context.Context, tx *sql.Tx, w, d, c, amount int) error {
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE warehouse SET w_ytd = w_ytd + $1 WHERE w_id = $2", amount, w,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE district SET d_ytd = d_ytd + $1 WHERE d_w_id = $2 AND d_id = $3", amount, w, d,
+	); err != nil {
+		return err
+	}
+	_, err := tx.ExecContext(ctx,
+		`UPDATE customer SET c_balance = c_balance - $1, c_payment_cnt = c_payment_cnt + 1
+		 WHERE c_w_id = $2 AND c_d_id = $3 AND c_id = $4`,
+		amount, w, d, c,
+	)
+	return err
+}
+
+func orderStatus(ctx context.Context, tx *sql.Tx, w, d, c int) error {
+	var balance int
+	if err := tx.QueryRowContext(ctx,
+		"SELECT c_balance FROM customer WHERE c_w_id = $1 AND c_d_id = $2 AND c_id = $3", w, d, c,
+	).Scan(&balance); err != nil {
+		return err
+	}
+	var o int
+	err := tx.QueryRowContext(ctx,
+		`SELECT o_id FROM orders WHERE o_w_id = $1 AND o_d_id = $2 AND o_c_id = $3
+		 ORDER BY o_id DESC LIMIT 1`,
+		w, d, c,
+	).Scan(&o)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	rows, err := tx.QueryContext(ctx,
+		`SELECT ol_i_id, ol_quantity, ol_amount FROM order_line
+		 WHERE ol_w_id = $1 AND ol_d_id = $2 AND ol_o_id = $3`,
+		w, d, o,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item, quantity, amount int
+		if err := rows.Scan(&item, &quantity, &amount); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,170 @@
+package workload
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 10000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	if h.Count() != 10000 {
+		t.Fatalf("count is %d", h.Count())
+	}
+	for _, tc := range []struct {
+		q    float64
+		want time.Duration
+	}{
+		{0.5, 5 * time.Millisecond},
+		{0.99, 9900 * time.Microsecond},
+		{0.999, 9990 * time.Microsecond},
+		{1, 10 * time.Millisecond},
+	} {
+		got := h.Quantile(tc.q)
+		if got < tc.want || float64(got-tc.want) > 0.02*float64(tc.want) {
+			t.Errorf("p%g is %s, expected %s within 2%%", tc.q*100, got, tc.want)
+		}
+	}
+	if h.Min() != time.Microsecond || h.Max() != 10*time.Millisecond {
+		t.Errorf("min and max are %s and %s", h.Min(), h.Max())
+	}
+
+	// Merging gives the same quantiles as recording everything in one.
+	var a, b, all Histogram
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		d := time.Duration(rng.Int63n(int64(time.Second)))
+		all.Record(d)
+		if i%2 == 0 {
+			a.Record(d)
+		} else {
+			b.Record(d)
+		}
+	}
+	a.Merge(&b)
+	for _, q := range []float64{0, 0.5, 0.9, 0.99, 1} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("p%g of merged is %s, expected %s", q*100, a.Quantile(q), all.Quantile(q))
+		}
+	}
+}
+
+func TestCheckSLO(t *testing.T) {
+	start := time.Now()
+	s := newStats(start, time.Second)
+	// A second of fast reads, then a second of slow and failing ones.
+	for i := 0; i < 1000; i++ {
+		s.record("read", start.Add(time.Duration(i)*time.Millisecond), time.Millisecond, nil)
+	}
+	for i := 0; i < 100; i++ {
+		var err error
+		if i%10 == 0 {
+			err = errors.New("boom")
+		}
+		s.record("read", start.Add(time.Second+time.Duration(i)*time.Millisecond), time.Second, err)
+	}
+	s.record("write", start, time.Minute, nil)
+
+	before := SLO{Op: "read", To: start.Add(time.Second), Quantile: 0.99, Latency: 10 * time.Millisecond, ErrorRate: 0.001}
+	if err := s.Check(before); err != nil {
+		t.Errorf("expected the SLO to be met before the fault: %v", err)
+	}
+	during := before
+	during.From, during.To = start.Add(time.Second), time.Time{}
+	err := s.Check(during)
+	if err == nil {
+		t.Fatal("expected the SLO to be missed during the fault")
+	}
+	if !strings.Contains(err.Error(), "p99 is") || !strings.Contains(err.Error(), "error rate is 10%") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := s.Check(SLO{To: start.Add(time.Second), Quantile: 1, Latency: time.Second}); err == nil {
+		t.Error("expected the SLO of all ops to count the slow write")
+	}
+}
+
+// sleepWorkload sleeps in every operation.
+type sleepWorkload time.Duration
+
+func (sleepWorkload) Setup(context.Context, *sql.DB) error { return nil }
+
+func (s sleepWorkload) Next(*rand.Rand) Op {
+	return Op{Name: "sleep", Run: func(ctx context.Context, _ *sql.DB) error {
+		time.Sleep(time.Duration(s))
+		return nil
+	}}
+}
+
+func TestOpenLoop(t *testing.T) {
+	// Operations of 50ms at 100/s overlap, and all start on schedule.
+	stats, err := Run(context.Background(), sleepWorkload(50*time.Millisecond), Config{
+		DBs:      []*sql.DB{nil},
+		Rate:     100,
+		Duration: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := stats.Total()["sleep"]
+	if o == nil {
+		t.Fatal("no operations were recorded")
+	}
+	if n := o.Latency.Count() + o.Errors; n < 90 || n > 110 {
+		t.Errorf("expected about 100 operations, got %d", n)
+	}
+	if max := o.Latency.Max(); max > 200*time.Millisecond {
+		t.Errorf("expected operations not to wait on each other, got a max latency of %s", max)
+	}
+
+	// With at most 2 in flight, the operations due while 2 run are not
+	// started, and count as errors.
+	stats, err = Run(context.Background(), sleepWorkload(50*time.Millisecond), Config{
+		DBs:         []*sql.DB{nil},
+		Rate:        100,
+		MaxInFlight: 2,
+		Duration:    time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o = stats.Total()["sleep"]
+	if n := o.Latency.Count(); n < 30 || n > 45 {
+		t.Errorf("expected about 40 operations to complete, got %d", n)
+	}
+	if o.Errors < 50 {
+		t.Errorf("expected about 60 operations over the limit, got %d errors", o.Errors)
+	}
+
+	// Operations still running at the end of the run count as errors.
+	stats, err = Run(context.Background(), blockWorkload{}, Config{
+		DBs:      []*sql.DB{nil},
+		Rate:     10,
+		Duration: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o = stats.Total()["block"]
+	if o == nil || o.Latency.Count() != 0 || o.Errors < 4 {
+		t.Errorf("expected every operation to be an error, got %+v", o)
+	}
+}
+
+// blockWorkload blocks in every operation until it is cancelled.
+type blockWorkload struct{}
+
+func (blockWorkload) Setup(context.Context, *sql.DB) error { return nil }
+
+func (blockWorkload) Next(*rand.Rand) Op {
+	return Op{Name: "block", Run: func(ctx context.Context, _ *sql.DB) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}}
+}